@@ -0,0 +1,342 @@
+// Package config loads the configuration of a service into a struct whose
+// fields are described by tags:
+//
+//	env:"PORT"        environment variable, wins over the file
+//	yaml:"port"       key in the YAML file given by --config or CONFIG_FILE
+//	default:"8080"    used when neither the file nor the environment set it
+//	required:"true"   must not end up empty
+//	validate:"port"   port, url, hostport or oneof=a b c
+//	secret:"true"     redacted by --print-config
+//
+// Fields are strings, bools, ints, floats, durations, string lists (comma
+// separated in the environment) or nested structs loaded the same way. A
+// config type can add checks across fields with a Validate() []string
+// method.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// Error lists every configuration problem, so they can be fixed in
+// one go instead of one restart at a time.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// cmdFlags are the command line flags every service understands. Args
+// holds the remaining arguments, e.g. a subcommand.
+type cmdFlags struct {
+	File  string
+	Print bool
+	Args  []string
+}
+
+func parseFlags(args []string) (cmdFlags, error) {
+	var f cmdFlags
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&f.File, "config", os.Getenv("CONFIG_FILE"), "YAML configuration `file`, environment variables take precedence")
+	fs.BoolVar(&f.Print, "print-config", false, "print the effective configuration with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return f, err
+	}
+	f.Args = fs.Args()
+	return f, nil
+}
+
+// MustLoad loads cfg, a pointer to a config struct, as described by
+// the command line args. With --print-config it prints the effective
+// configuration and exits. Invalid configuration is fatal. It returns the
+// arguments left after the flags.
+func MustLoad(cfg any, args []string) []string {
+	flags, err := parseFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		// The flag package has already printed the error and the usage.
+		os.Exit(2)
+	}
+
+	err = Load(cfg, flags.File)
+	if flags.Print {
+		if err := Print(os.Stdout, cfg); err != nil {
+			slog.Error("Failed to print configuration", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var cfgErr *Error
+	if errors.As(err, &cfgErr) {
+		slog.Error("Invalid configuration", "problems", cfgErr.Problems)
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if flags.Print {
+		os.Exit(0)
+	}
+	return flags.Args
+}
+
+// Load fills cfg from its defaults, the YAML file, if any, and the
+// environment, then validates it.
+func Load(cfg any, file string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, got %T", cfg)
+	}
+	v = v.Elem()
+
+	var problems []string
+	walk(v, "", func(f reflect.Value, field reflect.StructField, path string) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setValue(f, def); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid default %q: %v", fieldName(field, path), def, err))
+			}
+		}
+	})
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return fmt.Errorf("failed to parse config file %s: %w", file, err)
+			}
+			for _, msg := range typeErr.Errors {
+				problems = append(problems, file+": "+msg)
+			}
+		}
+	}
+
+	walk(v, "", func(f reflect.Value, field reflect.StructField, path string) {
+		name := field.Tag.Get("env")
+		if name == "" {
+			return
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return
+		}
+		if err := setValue(f, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	})
+
+	walk(v, "", func(f reflect.Value, field reflect.StructField, path string) {
+		name := fieldName(field, path)
+		if field.Tag.Get("required") == "true" && f.IsZero() {
+			problems = append(problems, name+": must be set")
+			return
+		}
+		if rule := field.Tag.Get("validate"); rule != "" && !f.IsZero() {
+			if err := validateValue(f, rule); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	})
+
+	if validator, ok := cfg.(interface{ Validate() []string }); ok {
+		problems = append(problems, validator.Validate()...)
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// walk calls fn for every leaf field of the struct v. path is the
+// dotted YAML path of the field.
+func walk(v reflect.Value, prefix string, fn func(f reflect.Value, field reflect.StructField, path string)) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		path := prefix + yamlKey(field)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			walk(f, path+".", fn)
+			continue
+		}
+		fn(f, field, path)
+	}
+}
+
+func yamlKey(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// fieldName names a field in error messages by the variable most people
+// set it with.
+func fieldName(field reflect.StructField, path string) string {
+	if name := field.Tag.Get("env"); name != "" {
+		return name
+	}
+	return path
+}
+
+func setValue(f reflect.Value, value string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported config type %s", f.Type())
+		}
+		var items []string
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported config type %s", f.Type())
+	}
+	return nil
+}
+
+func validateValue(f reflect.Value, rule string) error {
+	value := fmt.Sprint(f.Interface())
+
+	switch {
+	case rule == "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q, expected 1-65535", value)
+		}
+	case rule == "url":
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid URL: %v", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid URL %q, expected scheme://host", value)
+		}
+	case rule == "hostport":
+		if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+			return fmt.Errorf("invalid address %q, expected host:port", value)
+		}
+	case strings.HasPrefix(rule, "oneof="):
+		allowed := strings.Fields(strings.TrimPrefix(rule, "oneof="))
+		if !slices.Contains(allowed, value) {
+			return fmt.Errorf("invalid value %q, expected one of %s", value, strings.Join(allowed, ", "))
+		}
+	default:
+		return fmt.Errorf("unknown validation rule %q", rule)
+	}
+	return nil
+}
+
+// Print writes cfg as YAML, which can be used as a config file, with
+// the values of secret fields redacted.
+func Print(w io.Writer, cfg any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNode(reflect.Indirect(reflect.ValueOf(cfg)))); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func yamlNode(v reflect.Value) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		f := v.Field(i)
+
+		var value *yaml.Node
+		switch {
+		case f.Kind() == reflect.Struct:
+			value = yamlNode(f)
+		case field.Tag.Get("secret") == "true" && !f.IsZero():
+			value = &yaml.Node{Kind: yaml.ScalarNode, Value: redacted}
+		case f.Type() == durationType:
+			value = &yaml.Node{Kind: yaml.ScalarNode, Value: time.Duration(f.Int()).String()}
+		default:
+			value = &yaml.Node{}
+			if err := value.Encode(f.Interface()); err != nil {
+				value = &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(f.Interface())}
+			}
+			if value.Kind == yaml.SequenceNode {
+				value.Style = yaml.FlowStyle
+			}
+		}
+
+		if name := field.Tag.Get("env"); name != "" {
+			value.LineComment = name
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: yamlKey(field)}
+		node.Content = append(node.Content, key, value)
+	}
+	return node
+}
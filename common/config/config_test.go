@@ -0,0 +1,312 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSection struct {
+	Addr    string        `yaml:"addr" env:"TEST_ADDR" default:"localhost:4222" validate:"hostport"`
+	Timeout time.Duration `yaml:"timeout" env:"TEST_TIMEOUT" default:"5s"`
+}
+
+type testConfig struct {
+	Port    string      `yaml:"port" env:"TEST_PORT" default:"8080" validate:"port"`
+	URL     string      `yaml:"url" env:"TEST_URL" validate:"url"`
+	Mode    string      `yaml:"mode" env:"TEST_MODE" default:"a" validate:"oneof=a b"`
+	Token   string      `yaml:"token" env:"TEST_TOKEN" secret:"true"`
+	Debug   bool        `yaml:"debug" env:"TEST_DEBUG"`
+	Limit   int         `yaml:"limit" env:"TEST_LIMIT" default:"10"`
+	Ratio   float64     `yaml:"ratio" env:"TEST_RATIO" default:"0.5"`
+	Origins []string    `yaml:"origins" env:"TEST_ORIGINS"`
+	Section testSection `yaml:"section"`
+}
+
+func (c testConfig) Validate() []string {
+	if c.Debug && c.Token == "" {
+		return []string{"TEST_TOKEN: must be set with TEST_DEBUG"}
+	}
+	return nil
+}
+
+type requiredConfig struct {
+	Name string `env:"TEST_NAME" required:"true"`
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	defaults := testConfig{
+		Port:    "8080",
+		Mode:    "a",
+		Limit:   10,
+		Ratio:   0.5,
+		Section: testSection{Addr: "localhost:4222", Timeout: 5 * time.Second},
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string
+		want func(c *testConfig)
+	}{
+		{
+			name: "defaults",
+			want: func(c *testConfig) {},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"TEST_PORT":    "9090",
+				"TEST_URL":     "http://backend:8080",
+				"TEST_DEBUG":   "true",
+				"TEST_TOKEN":   "s3cret",
+				"TEST_LIMIT":   "3",
+				"TEST_RATIO":   "0.25",
+				"TEST_ORIGINS": "http://a, ,http://b",
+				"TEST_ADDR":    "nats:4222",
+				"TEST_TIMEOUT": "1m",
+			},
+			want: func(c *testConfig) {
+				c.Port = "9090"
+				c.URL = "http://backend:8080"
+				c.Debug = true
+				c.Token = "s3cret"
+				c.Limit = 3
+				c.Ratio = 0.25
+				c.Origins = []string{"http://a", "http://b"}
+				c.Section = testSection{Addr: "nats:4222", Timeout: time.Minute}
+			},
+		},
+		{
+			name: "file",
+			file: "port: 9000\norigins: [http://a]\nsection:\n  timeout: 2s\n",
+			want: func(c *testConfig) {
+				c.Port = "9000"
+				c.Origins = []string{"http://a"}
+				c.Section.Timeout = 2 * time.Second
+			},
+		},
+		{
+			name: "environment wins over file",
+			env:  map[string]string{"TEST_PORT": "9090"},
+			file: "port: 9000\nmode: b\n",
+			want: func(c *testConfig) {
+				c.Port = "9090"
+				c.Mode = "b"
+			},
+		},
+		{
+			name: "empty environment variable is ignored",
+			env:  map[string]string{"TEST_PORT": ""},
+			file: "port: 9000\n",
+			want: func(c *testConfig) {
+				c.Port = "9000"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var file string
+			if tt.file != "" {
+				file = writeFile(t, tt.file)
+			}
+
+			var got testConfig
+			if err := Load(&got, file); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			want := defaults
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  any
+		env  map[string]string
+		file string
+		want []string
+	}{
+		{
+			name: "required",
+			cfg:  &requiredConfig{},
+			want: []string{"TEST_NAME: must be set"},
+		},
+		{
+			name: "invalid port",
+			cfg:  &testConfig{},
+			env:  map[string]string{"TEST_PORT": "70000"},
+			want: []string{`TEST_PORT: invalid port "70000", expected 1-65535`},
+		},
+		{
+			name: "invalid url",
+			cfg:  &testConfig{},
+			env:  map[string]string{"TEST_URL": "backend"},
+			want: []string{`TEST_URL: invalid URL "backend", expected scheme://host`},
+		},
+		{
+			name: "invalid hostport",
+			cfg:  &testConfig{},
+			env:  map[string]string{"TEST_ADDR": "nats"},
+			want: []string{`TEST_ADDR: invalid address "nats", expected host:port`},
+		},
+		{
+			name: "invalid oneof",
+			cfg:  &testConfig{},
+			env:  map[string]string{"TEST_MODE": "c"},
+			want: []string{`TEST_MODE: invalid value "c", expected one of a, b`},
+		},
+		{
+			name: "unparsable values are all reported",
+			cfg:  &testConfig{},
+			env: map[string]string{
+				"TEST_DEBUG":   "maybe",
+				"TEST_LIMIT":   "ten",
+				"TEST_TIMEOUT": "soon",
+			},
+			want: []string{
+				`TEST_DEBUG: invalid boolean "maybe"`,
+				`TEST_LIMIT: invalid integer "ten"`,
+				`TEST_TIMEOUT: invalid duration "soon"`,
+			},
+		},
+		{
+			name: "validate method",
+			cfg:  &testConfig{},
+			env:  map[string]string{"TEST_DEBUG": "true"},
+			want: []string{"TEST_TOKEN: must be set with TEST_DEBUG"},
+		},
+		{
+			name: "file type error",
+			cfg:  &testConfig{},
+			file: "limit: many\n",
+			want: []string{"cannot unmarshal"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var file string
+			if tt.file != "" {
+				file = writeFile(t, tt.file)
+			}
+
+			err := Load(tt.cfg, file)
+			var cfgErr *Error
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("Load() error = %v, want *Error", err)
+			}
+			if len(cfgErr.Problems) != len(tt.want) {
+				t.Fatalf("Load() problems = %q, want %q", cfgErr.Problems, tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(cfgErr.Problems[i], want) {
+					t.Errorf("problem %d = %q, want it to contain %q", i, cfgErr.Problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  any
+		file string
+		want string
+	}{
+		{name: "not a pointer", cfg: testConfig{}, want: "must be a pointer to a struct"},
+		{name: "missing file", cfg: &testConfig{}, file: "/nonexistent/config.yaml", want: "failed to read config file"},
+		{name: "unknown key", cfg: &testConfig{}, file: "unknown: 1\n", want: "field unknown not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tt.file
+			if file != "" && !strings.HasPrefix(file, "/") {
+				file = writeFile(t, file)
+			}
+			err := Load(tt.cfg, file)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "secret is redacted", token: "s3cret", want: "token: REDACTED # TEST_TOKEN"},
+		{name: "empty secret is shown", token: "", want: `token: "" # TEST_TOKEN`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_TOKEN", tt.token)
+			t.Setenv("TEST_ORIGINS", "http://a,http://b")
+			var cfg testConfig
+			if err := Load(&cfg, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			var b strings.Builder
+			if err := Print(&b, &cfg); err != nil {
+				t.Fatalf("Print() error = %v", err)
+			}
+			out := b.String()
+			for _, want := range []string{
+				tt.want,
+				"port: \"8080\" # TEST_PORT",
+				"origins: ['http://a', 'http://b'] # TEST_ORIGINS",
+				"section:\n  addr: localhost:4222 # TEST_ADDR\n  timeout: 5s # TEST_TIMEOUT",
+			} {
+				if !strings.Contains(out, want) {
+					t.Errorf("Print() = %s\nwant it to contain %q", out, want)
+				}
+			}
+			if tt.token != "" && strings.Contains(out, tt.token) {
+				t.Errorf("Print() leaked the secret: %s", out)
+			}
+
+			// The printed configuration can be loaded back as a file.
+			var loaded testConfig
+			t.Setenv("TEST_TOKEN", "")
+			t.Setenv("TEST_ORIGINS", "")
+			if err := Load(&loaded, writeFile(t, out)); err != nil {
+				t.Fatalf("Load(printed) error = %v", err)
+			}
+			if !reflect.DeepEqual(loaded.Origins, cfg.Origins) || loaded.Section != cfg.Section {
+				t.Errorf("Load(printed) = %+v, want %+v", loaded, cfg)
+			}
+		})
+	}
+}
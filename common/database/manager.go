@@ -0,0 +1,222 @@
+// Package database manages the Postgres connection of a service and its
+// schema migrations.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+	pingTimeout    = 2 * time.Second
+)
+
+type connState string
+
+const (
+	connecting   connState = "connecting"
+	connected    connState = "connected"
+	disconnected connState = "disconnected"
+)
+
+// ErrClosed is returned by Connect when the Manager was closed meanwhile.
+var ErrClosed = errors.New("database manager is closed")
+
+// Config is the database section of the service configuration.
+type Config struct {
+	URL string `env:"DB_URL" yaml:"url" required:"true" secret:"true" validate:"url"`
+	// ConnectTimeout bounds how long the first connection may be retried
+	// before the service gives up and exits.
+	ConnectTimeout time.Duration `env:"DB_CONNECT_TIMEOUT" yaml:"connect_timeout" default:"5m"`
+	CheckInterval  time.Duration `env:"DB_CHECK_INTERVAL" yaml:"check_interval" default:"10s"`
+
+	MaxOpenConns    int           `env:"DB_MAX_OPEN_CONNS" yaml:"max_open_conns" default:"10"`
+	MaxIdleConns    int           `env:"DB_MAX_IDLE_CONNS" yaml:"max_idle_conns" default:"5"`
+	ConnMaxLifetime time.Duration `env:"DB_CONN_MAX_LIFETIME" yaml:"conn_max_lifetime" default:"30m"`
+	ConnMaxIdleTime time.Duration `env:"DB_CONN_MAX_IDLE_TIME" yaml:"conn_max_idle_time" default:"5m"`
+}
+
+// Manager owns the database handle. It connects with exponential backoff,
+// keeps watching the connection afterwards and reports its state to the
+// readiness probe.
+type Manager struct {
+	// Driver is the database/sql driver name, "postgres" unless it's wrapped
+	// e.g. for tracing. It must be set before Connect.
+	Driver string
+
+	cfg Config
+	// init runs once after the first successful connection, e.g. migrations.
+	init func(ctx context.Context, db *sql.DB) error
+
+	mu      sync.RWMutex
+	db      *sql.DB
+	state   connState
+	lastErr error
+	// closed is set by Close, a handle Connect opens afterwards is closed
+	// right away instead of leaking.
+	closed bool
+}
+
+// NewManager returns a Manager for cfg. init may be nil.
+func NewManager(cfg Config, init func(ctx context.Context, db *sql.DB) error) *Manager {
+	return &Manager{
+		Driver: "postgres",
+		cfg:    cfg,
+		init:   init,
+		state:  connecting,
+	}
+}
+
+// DB returns the database handle, or nil until the first connection and
+// initialisation succeeded.
+func (m *Manager) DB() *sql.DB {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.db
+}
+
+func (m *Manager) setState(state connState, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state != state {
+		slog.Info("Database state changed", "state", state)
+	}
+	m.state = state
+	m.lastErr = err
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := min(retryBaseDelay<<min(attempt, 16), retryMaxDelay)
+	// Full jitter, so replicas restarted together don't retry in lockstep.
+	return time.Duration(rand.Int63n(int64(delay))) + time.Millisecond
+}
+
+// Connect opens, pings and initialises the database, retrying until it
+// succeeds or ctx is done. It returns ErrClosed if Close was called in the
+// meantime.
+func (m *Manager) Connect(ctx context.Context) error {
+	db, err := sql.Open(m.Driver, m.cfg.URL)
+	if err != nil {
+		return fmt.Errorf("failed to open database connection: %w", err)
+	}
+	db.SetMaxOpenConns(m.cfg.MaxOpenConns)
+	db.SetMaxIdleConns(m.cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(m.cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(m.cfg.ConnMaxIdleTime)
+
+	for attempt := 0; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil && m.init != nil {
+			err = m.init(ctx, db)
+		}
+		if err == nil {
+			break
+		}
+
+		m.setState(connecting, err)
+		delay := retryDelay(attempt)
+		slog.Warn("Database not ready, retrying", "attempt", attempt+1, "retry_in", delay.Round(time.Millisecond).String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return fmt.Errorf("gave up connecting to database: %w", err)
+		case <-time.After(delay):
+		}
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		db.Close()
+		return ErrClosed
+	}
+	m.db = db
+	m.mu.Unlock()
+	m.setState(connected, nil)
+	slog.Info("Successfully connected to the database")
+	return nil
+}
+
+// Watch pings the database every DB_CHECK_INTERVAL until ctx is done. When
+// the database goes away it is marked disconnected and re-pinged with
+// backoff; sql.DB replaces the broken connections by itself.
+func (m *Manager) Watch(ctx context.Context) {
+	interval := m.cfg.CheckInterval
+	attempt := 0
+
+	for {
+		wait := interval
+		if attempt > 0 {
+			wait = retryDelay(attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		db := m.DB()
+		if db == nil {
+			continue
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err := db.PingContext(pingCtx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.setState(disconnected, err)
+			slog.Error("Lost database connection, reconnecting", "error", err)
+			attempt++
+			continue
+		}
+
+		m.setState(connected, nil)
+		attempt = 0
+	}
+}
+
+// Check is used by the readiness probe.
+func (m *Manager) Check(ctx context.Context) error {
+	m.mu.RLock()
+	db, state, lastErr := m.db, m.state, m.lastErr
+	m.mu.RUnlock()
+
+	if db == nil || state != connected {
+		if lastErr != nil {
+			return fmt.Errorf("database is %s: %w", state, lastErr)
+		}
+		return fmt.Errorf("database is %s", state)
+	}
+	return db.PingContext(ctx)
+}
+
+// Close closes the database handle, also one Connect is still opening.
+// DB returns nil afterwards.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	db := m.db
+	m.db = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			slog.Error("Error closing database connection", "error", err)
+		}
+	}
+}
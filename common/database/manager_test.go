@@ -0,0 +1,85 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDriver hands out connections that only count how many are open.
+type fakeDriver struct {
+	open atomic.Int32
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	d.open.Add(1)
+	return &fakeConn{d: d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Close() error {
+	c.d.open.Add(-1)
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	return nil
+}
+
+var fake = &fakeDriver{}
+
+func init() {
+	sql.Register("fake", fake)
+}
+
+func TestManagerClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// closeDuringInit closes the manager while Connect is still
+		// initialising the database.
+		closeDuringInit bool
+		wantErr         error
+	}{
+		{name: "close after connect", wantErr: nil},
+		{name: "close during connect", closeDuringInit: true, wantErr: ErrClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m *Manager
+			m = NewManager(Config{URL: "fake://", MaxOpenConns: 1, MaxIdleConns: 1}, func(ctx context.Context, db *sql.DB) error {
+				if tt.closeDuringInit {
+					m.Close()
+				}
+				return nil
+			})
+			m.Driver = "fake"
+
+			if err := m.Connect(context.Background()); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Connect() error = %v, want %v", err, tt.wantErr)
+			}
+			m.Close()
+
+			if db := m.DB(); db != nil {
+				t.Errorf("DB() = %v after Close, want nil", db)
+			}
+			if n := fake.open.Load(); n != 0 {
+				t.Errorf("%d connections left open", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrator applies the schema migrations of one service. The migrations are
+// NNNN_name.up.sql / NNNN_name.down.sql pairs in Dir of FS, usually embedded
+// into the binary.
+type Migrator struct {
+	// Service scopes rows in schema_migrations, so several services can share
+	// one database without their version numbers clashing.
+	Service string
+	// LockID is the key of the Postgres advisory lock that serialises
+	// migrations between replicas sharing the same database. Every service
+	// needs its own.
+	LockID int64
+	FS     fs.FS
+	Dir    string
+}
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Checksum of the up script, recorded when it is applied so later edits
+	// of an applied migration are noticed.
+	Checksum string
+}
+
+// MigrationStatus is a line of `migrate status`.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+	// Changed is set if the up script differs from the applied one.
+	Changed bool
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := migrationFileRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name: %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// withLock runs fn on a single connection holding the migration advisory
+// lock, so concurrent replicas wait for each other.
+func (r *Migrator) withLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", r.LockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", r.LockID); err != nil {
+			slog.Error("Error releasing migration lock", "error", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			service TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (service, version)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum TEXT"); err != nil {
+		return fmt.Errorf("failed to add checksum to schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// applied returns the checksums of the applied versions, empty for versions
+// applied before checksums were recorded.
+func (r *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, COALESCE(checksum, '') FROM schema_migrations WHERE service = $1", r.Service)
+	if err != nil {
+		return nil, fmt.Errorf("error querying schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]string{}
+	for rows.Next() {
+		var version int
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, fmt.Errorf("error scanning schema_migrations row: %w", err)
+		}
+		applied[version] = checksum
+	}
+
+	return applied, rows.Err()
+}
+
+func (r *Migrator) apply(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record := m.Up, "INSERT INTO schema_migrations (service, version, name, checksum) VALUES ($1, $2, $3, $4)"
+	args := []any{r.Service, m.Version, m.Name, m.Checksum}
+	if !up {
+		script, record = m.Down, "DELETE FROM schema_migrations WHERE service = $1 AND version = $2 AND name = $3"
+		args = args[:3]
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Up applies the pending migrations. It refuses to run if an applied
+// migration was edited since.
+func (r *Migrator) Up(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations(r.FS, r.Dir)
+	if err != nil {
+		return err
+	}
+
+	return r.withLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			checksum, ok := applied[m.Version]
+			if ok && checksum != "" && checksum != m.Checksum {
+				return fmt.Errorf("migration %d_%s was changed after it was applied, add a new migration instead", m.Version, m.Name)
+			}
+		}
+
+		for _, m := range migrations {
+			checksum, ok := applied[m.Version]
+			if ok {
+				if checksum == "" {
+					// Applied before checksums were recorded.
+					_, err := conn.ExecContext(ctx, "UPDATE schema_migrations SET checksum = $3 WHERE service = $1 AND version = $2", r.Service, m.Version, m.Checksum)
+					if err != nil {
+						return fmt.Errorf("failed to record checksum of migration %d_%s: %w", m.Version, m.Name, err)
+					}
+				}
+				continue
+			}
+			slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+			if err := r.apply(ctx, conn, m, true); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Down reverts the latest steps applied migrations.
+func (r *Migrator) Down(ctx context.Context, db *sql.DB, steps int) error {
+	migrations, err := loadMigrations(r.FS, r.Dir)
+	if err != nil {
+		return err
+	}
+
+	return r.withLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+			}
+			slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+			if err := r.apply(ctx, conn, m, false); err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// Status lists all migrations and whether they are applied.
+func (r *Migrator) Status(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(r.FS, r.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	err = r.withLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			checksum, ok := applied[m.Version]
+			statuses = append(statuses, MigrationStatus{
+				Version: m.Version,
+				Name:    m.Name,
+				Applied: ok,
+				Changed: ok && checksum != "" && checksum != m.Checksum,
+			})
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// RunCommand implements the `migrate [up|down [N]|status]` subcommand used
+// by the pre-rollout Kubernetes Job. cfg is the database section of the
+// service configuration, so the Job can share its config file.
+func (r *Migrator) RunCommand(cfg Config, args []string) error {
+	dbm := NewManager(cfg, nil)
+
+	ctx := context.Background()
+
+	connectCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	if err := dbm.Connect(connectCtx); err != nil {
+		return err
+	}
+	defer dbm.Close()
+	db := dbm.DB()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		if err := r.Up(ctx, db); err != nil {
+			return err
+		}
+		slog.Info("Migrations applied successfully")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		if err := r.Down(ctx, db, steps); err != nil {
+			return err
+		}
+		slog.Info("Reverted migrations", "steps", steps)
+	case "status":
+		statuses, err := r.Status(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			if s.Changed {
+				state += ", changed since"
+			}
+			fmt.Printf("%04d_%s: %s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected up, down or status", action)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	const (
+		createSQL = "CREATE TABLE t (id INT);"
+		alterSQL  = "ALTER TABLE t ADD COLUMN name TEXT;"
+	)
+
+	tests := []struct {
+		name         string
+		files        map[string]string
+		wantVersions []int
+		wantErr      string
+	}{
+		{
+			name: "sorted by version",
+			files: map[string]string{
+				"0010_add_index.up.sql":   "CREATE INDEX i ON t (id);",
+				"0002_add_name.up.sql":    alterSQL,
+				"0002_add_name.down.sql":  "ALTER TABLE t DROP COLUMN name;",
+				"0001_create_t.up.sql":    createSQL,
+				"0001_create_t.down.sql":  "DROP TABLE t;",
+				"0010_add_index.down.sql": "DROP INDEX i;",
+			},
+			wantVersions: []int{1, 2, 10},
+		},
+		{
+			name:         "down file is optional",
+			files:        map[string]string{"0001_create_t.up.sql": createSQL},
+			wantVersions: []int{1},
+		},
+		{
+			name:         "empty directory",
+			files:        map[string]string{},
+			wantVersions: []int{},
+		},
+		{
+			name:    "unexpected file name",
+			files:   map[string]string{"0001_create_t.sql": createSQL},
+			wantErr: "unexpected migration file name: 0001_create_t.sql",
+		},
+		{
+			name: "conflicting names",
+			files: map[string]string{
+				"0001_create_t.up.sql":   createSQL,
+				"0001_create_u.down.sql": "DROP TABLE u;",
+			},
+			wantErr: "conflicting names",
+		},
+		{
+			name:    "missing up file",
+			files:   map[string]string{"0001_create_t.down.sql": "DROP TABLE t;"},
+			wantErr: "migration 1_create_t has no up file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{"migrations": &fstest.MapFile{Mode: fs.ModeDir | 0o755}}
+			for name, content := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte(content)}
+			}
+
+			migrations, err := loadMigrations(fsys, "migrations")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMigrations() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadMigrations() error = %v", err)
+			}
+
+			versions := []int{}
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+				if m.Up == "" || m.Checksum == "" {
+					t.Errorf("migration %d has no up script or checksum", m.Version)
+				}
+			}
+			if len(versions) != len(tt.wantVersions) {
+				t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+			}
+			for i := range versions {
+				if versions[i] != tt.wantVersions[i] {
+					t.Fatalf("versions = %v, want %v", versions, tt.wantVersions)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	load := func(up, down string) migration {
+		t.Helper()
+		fsys := fstest.MapFS{
+			"migrations/0001_create_t.up.sql":   &fstest.MapFile{Data: []byte(up)},
+			"migrations/0001_create_t.down.sql": &fstest.MapFile{Data: []byte(down)},
+		}
+		migrations, err := loadMigrations(fsys, "migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migrations[0]
+	}
+
+	base := load("CREATE TABLE t (id INT);", "DROP TABLE t;")
+	tests := []struct {
+		name     string
+		up, down string
+		wantSame bool
+	}{
+		{name: "same scripts", up: "CREATE TABLE t (id INT);", down: "DROP TABLE t;", wantSame: true},
+		{name: "down script changed", up: "CREATE TABLE t (id INT);", down: "DROP TABLE IF EXISTS t;", wantSame: true},
+		{name: "up script changed", up: "CREATE TABLE t (id BIGINT);", down: "DROP TABLE t;", wantSame: false},
+		{name: "whitespace changed", up: "CREATE TABLE t (id INT);\n", down: "DROP TABLE t;", wantSame: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := load(tt.up, tt.down)
+			if same := m.Checksum == base.Checksum; same != tt.wantSame {
+				t.Errorf("checksum %s, base %s: same = %v, want %v", m.Checksum, base.Checksum, same, tt.wantSame)
+			}
+		})
+	}
+}
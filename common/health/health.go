@@ -0,0 +1,157 @@
+// Package health serves the liveness and readiness probes of a service.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the health section of the service configuration.
+type Config struct {
+	// CacheTTL is how long a readiness result is reused.
+	CacheTTL time.Duration `env:"HEALTH_CACHE_TTL" yaml:"cache_ttl" default:"5s"`
+	// Timeout bounds each dependency check.
+	Timeout time.Duration `env:"HEALTH_TIMEOUT" yaml:"timeout" default:"2s"`
+}
+
+// Check probes a single dependency. Optional dependencies are
+// reported but don't make the service unready.
+type Check struct {
+	Name     string
+	Optional bool
+	Check    func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Optional bool   `json:"optional,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]checkResult `json:"checks"`
+}
+
+// Checker serves /livez and /readyz. Readiness results are cached for
+// cfg.CacheTTL so frequent probes don't hammer the dependencies.
+type Checker struct {
+	checks       []Check
+	ttl          time.Duration
+	timeout      time.Duration
+	shuttingDown *atomic.Bool
+
+	mu     sync.Mutex
+	report *healthReport
+}
+
+// NewChecker returns a Checker of checks. The service is reported as not
+// ready once shuttingDown is set.
+func NewChecker(cfg Config, shuttingDown *atomic.Bool, checks ...Check) *Checker {
+	return &Checker{
+		checks:       checks,
+		ttl:          cfg.CacheTTL,
+		timeout:      cfg.Timeout,
+		shuttingDown: shuttingDown,
+	}
+}
+
+func (c *Checker) run(ctx context.Context) *healthReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.report != nil && time.Since(c.report.CheckedAt) < c.ttl {
+		return c.report
+	}
+
+	report := &healthReport{
+		Status:    "ok",
+		CheckedAt: time.Now(),
+		Checks:    make(map[string]checkResult, len(c.checks)),
+	}
+
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(checkCtx)
+			result := checkResult{
+				Status:   "ok",
+				Optional: check.Optional,
+				Duration: time.Since(start).Round(time.Millisecond).String(),
+			}
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				if check.Optional {
+					if report.Status == "ok" {
+						report.Status = "degraded"
+					}
+				} else {
+					report.Status = "failing"
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name, result := range report.Checks {
+		if result.Status != "ok" && (c.report == nil || c.report.Checks[name].Status == "ok") {
+			slog.Warn("Health check is failing", "check", name, "optional", result.Optional, "error", result.Error)
+		}
+	}
+
+	c.report = report
+	return report
+}
+
+// HandleLive answers the liveness probe.
+func (c *Checker) HandleLive(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "alive")
+}
+
+// HandleReady answers the readiness probe with a JSON report of the
+// checks.
+func (c *Checker) HandleReady(w http.ResponseWriter, _ *http.Request) {
+	var report healthReport
+	if c.shuttingDown.Load() {
+		report = healthReport{Status: "shutting_down", CheckedAt: time.Now()}
+	} else {
+		// Not the request context: the result is cached for other probes.
+		report = *c.run(context.Background())
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" && report.Status != "degraded" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Error writing health report", "error", err)
+	}
+}
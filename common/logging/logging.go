@@ -0,0 +1,172 @@
+// Package logging sets up structured JSON logging and the per-request
+// access log shared by the services.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RequestIDHeader is read from incoming requests, set on responses and
+// forwarded to other services so one request can be followed in Loki.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// Setup makes slog, and the standard log package through it, write
+// JSON lines to stdout. LOG_LEVEL is one of debug, info (default), warn or
+// error.
+func Setup(service string) {
+	level := slog.LevelInfo
+	var levelErr error
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		levelErr = level.UnmarshalText([]byte(value))
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}).With("service", service))
+
+	if levelErr != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "error", levelErr)
+	}
+}
+
+// contextHandler adds the request ID of the context to every record, so
+// slog.InfoContext(r.Context(), ...) doesn't need to repeat it.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID id, e.g. one
+// received with a message, so it is logged and forwarded.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID guards the logs against arbitrary client input.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// StatusRecorder remembers the status code written through it, for
+// middlewares that report it once the handler is done.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// NewStatusRecorder wraps w.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+func (w *StatusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *StatusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status is the status code of the response, 200 if the handler wrote
+// nothing.
+func (w *StatusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Requests assigns every request an ID, honouring X-Request-ID
+// from the caller, and writes one access log line per request. Probes and
+// scrapes are only logged at debug level.
+func Requests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !ValidRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		rec := NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		// ServeMux sets r.Pattern on the request it routed.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.Status() >= 500:
+			level = slog.LevelError
+		case r.URL.Path == "/livez" || r.URL.Path == "/readyz" || r.URL.Path == "/healthz" || r.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		}
+
+		slog.Log(r.Context(), level, "HTTP request",
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,46 @@
+// Package metrics exposes the HTTP request metrics shared by the services.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// Requests records http_requests_total and http_request_duration_seconds.
+// The route label is the ServeMux pattern that matched, e.g.
+// "/todos/{id}", so IDs don't blow up the cardinality.
+func Requests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := logging.NewStatusRecorder(w)
+
+		next.ServeHTTP(rec, r)
+
+		// ServeMux sets r.Pattern on the request it routed.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+
+		requestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status())).Inc()
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /todos/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("todo"))
+	})
+	mux.HandleFunc("DELETE /todos/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /empty", func(w http.ResponseWriter, r *http.Request) {})
+	handler := Requests(mux)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		route  string
+		code   string
+	}{
+		{name: "written body", method: http.MethodGet, path: "/todos/1", route: "GET /todos/{id}", code: "200"},
+		{name: "status only", method: http.MethodDelete, path: "/todos/2", route: "DELETE /todos/{id}", code: "204"},
+		{name: "nothing written", method: http.MethodGet, path: "/empty", route: "GET /empty", code: "200"},
+		{name: "unmatched", method: http.MethodGet, path: "/nope", route: "unmatched", code: "404"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := requestsTotal.WithLabelValues(tt.route, tt.method, tt.code)
+			before := testutil.ToFloat64(counter)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("http_requests_total{route=%q, method=%q, code=%q} grew by %v, want 1", tt.route, tt.method, tt.code, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Package shutdown runs an HTTP server until the pod is asked to stop and
+// then drains it without dropping requests.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Config is the shutdown section of the service configuration.
+type Config struct {
+	// Delay gives Kubernetes time to notice the failing readiness probe and
+	// stop routing new requests to the pod.
+	Delay time.Duration `env:"SHUTDOWN_DELAY" yaml:"delay" default:"5s"`
+	// Timeout bounds how long in-flight requests may take.
+	Timeout time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"timeout" default:"15s"`
+}
+
+// Serve serves srv until ctx is cancelled by SIGINT or SIGTERM. It then
+// calls notReady, waits cfg.Delay and drains in-flight requests for at most
+// cfg.Timeout.
+func Serve(ctx context.Context, srv *http.Server, cfg Config, notReady func()) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutdown signal received, failing readiness before draining", "delay", cfg.Delay.String())
+	notReady()
+	time.Sleep(cfg.Delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %w", err)
+	}
+
+	slog.Info("Server stopped gracefully")
+	return nil
+}
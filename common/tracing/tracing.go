@@ -0,0 +1,131 @@
+// Package tracing sets up OpenTelemetry tracing and instruments HTTP
+// servers and clients.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. OTEL_TRACES_EXPORTER picks the exporter: "otlp" (the default
+// when OTEL_EXPORTER_OTLP_ENDPOINT is set), "stdout" or "none". The OTLP
+// exporter reads the standard OTEL_EXPORTER_OTLP_* variables and
+// OTEL_SERVICE_NAME overrides serviceName.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	exporterName := os.Getenv("OTEL_TRACES_EXPORTER")
+	if exporterName == "" {
+		exporterName = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			exporterName = "otlp"
+		}
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporterName, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil && !errors.Is(err, resource.ErrPartialResource) {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	slog.Info("Tracing enabled", "exporter", exporterName)
+
+	return tp.Shutdown, nil
+}
+
+// Handler starts a server span per request, continuing the trace of the
+// caller. Probes and scrapes are not traced. The span is named after the
+// method and operation until Routes renames it after the matched route.
+func Handler(next http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(next, operation,
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/livez", "/readyz", "/healthz", "/metrics":
+				return false
+			}
+			return true
+		}),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return r.Method + " " + operation
+		}),
+	)
+}
+
+// Routes names the span of Handler after the ServeMux pattern that matched,
+// e.g. "GET /todos/{id}", and sets http.route. It must wrap the mux itself:
+// ServeMux sets r.Pattern only on the request it is given, and middlewares
+// in between pass on copies.
+func Routes(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+
+		if r.Pattern == "" {
+			return
+		}
+		// http.route is the path template, without the method of patterns
+		// like "GET /todos/{id}".
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = strings.TrimLeft(path, " \t")
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route))
+	})
+}
+
+// Client returns a copy of client that propagates the trace context on
+// outgoing requests and records a client span for each of them.
+func Client(client *http.Client) *http.Client {
+	traced := *client
+	transport := traced.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	traced.Transport = otelhttp.NewTransport(transport)
+	return &traced
+}
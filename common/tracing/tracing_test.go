@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type ctxKey struct{}
+
+// copyRequest stands in for middlewares like request logging, which pass a
+// copy of the request on.
+func copyRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, true)))
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer tp.Shutdown(context.Background())
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /todos/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {})
+	handler := Handler(copyRequest(Routes(mux)), "todo-backend")
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantSpan  bool
+		wantName  string
+		wantRoute string
+	}{
+		{name: "matched route", method: http.MethodGet, path: "/todos/42", wantSpan: true, wantName: "GET /todos/{id}", wantRoute: "/todos/{id}"},
+		{name: "pattern without method", method: http.MethodHead, path: "/static/app.js", wantSpan: true, wantName: "HEAD /static/", wantRoute: "/static/"},
+		{name: "unmatched", method: http.MethodGet, path: "/nope", wantSpan: true, wantName: "GET todo-backend"},
+		{name: "wrong method", method: http.MethodDelete, path: "/todos/42", wantSpan: true, wantName: "DELETE todo-backend"},
+		{name: "probe is not traced", method: http.MethodGet, path: "/livez"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(recorder.Ended())
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+
+			spans := recorder.Ended()[before:]
+			if !tt.wantSpan {
+				if len(spans) != 0 {
+					t.Fatalf("got %d spans, want none", len(spans))
+				}
+				return
+			}
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+
+			span := spans[0]
+			if span.Name() != tt.wantName {
+				t.Errorf("span name = %q, want %q", span.Name(), tt.wantName)
+			}
+			var route string
+			for _, attr := range span.Attributes() {
+				if attr.Key == attribute.Key("http.route") {
+					route = attr.Value.AsString()
+				}
+			}
+			if route != tt.wantRoute {
+				t.Errorf("http.route = %q, want %q", route, tt.wantRoute)
+			}
+		})
+	}
+}
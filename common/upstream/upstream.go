@@ -0,0 +1,317 @@
+// Package upstream is the HTTP client for calls from one service to
+// another, with timeouts, retries and a circuit breaker per host.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_requests_total",
+		Help: "Outgoing HTTP attempts by upstream host, method and result: the status code, error or circuit_open.",
+	}, []string{"upstream", "method", "result"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_request_duration_seconds",
+		Help:    "Outgoing HTTP attempt latency by upstream host and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "method"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_retries_total",
+		Help: "Retried outgoing HTTP requests by upstream host.",
+	}, []string{"upstream"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_circuit_state",
+		Help: "Circuit breaker state by upstream host: 0 closed, 1 half-open, 2 open.",
+	}, []string{"upstream"})
+)
+
+// ErrCircuitOpen is returned without calling the upstream while its
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Config is the section of the service configuration for calls to
+// other services.
+type Config struct {
+	// Timeout bounds every attempt, including reading the response body.
+	Timeout time.Duration `env:"UPSTREAM_TIMEOUT" yaml:"timeout" default:"10s"`
+	// Retries is how often GET, HEAD, OPTIONS and PUT requests are retried
+	// after network errors and 502, 503 and 504 responses.
+	Retries      int           `env:"UPSTREAM_RETRIES" yaml:"retries" default:"2"`
+	RetryBackoff time.Duration `env:"UPSTREAM_RETRY_BACKOFF" yaml:"retry_backoff" default:"100ms"`
+	// The circuit of a host opens after BreakerFailures failed attempts in
+	// a row. After BreakerCooldown a single request is let through to probe
+	// whether it is back.
+	BreakerFailures int           `env:"UPSTREAM_BREAKER_FAILURES" yaml:"breaker_failures" default:"5"`
+	BreakerCooldown time.Duration `env:"UPSTREAM_BREAKER_COOLDOWN" yaml:"breaker_cooldown" default:"30s"`
+}
+
+// Client is the HTTP client for calls to other services. Failing
+// upstreams make callers fail fast instead of piling up hung requests.
+type Client struct {
+	client *http.Client
+	cfg    Config
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// NewClient wraps client, whose own Timeout is replaced by
+// cfg.Timeout per attempt.
+func NewClient(cfg Config, client *http.Client) *Client {
+	c := *client
+	c.Timeout = 0
+	return &Client{
+		client:   &c,
+		cfg:      cfg,
+		breakers: map[string]*circuitBreaker{},
+	}
+}
+
+func (c *Client) breaker(host string) *circuitBreaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &circuitBreaker{host: host, threshold: c.cfg.BreakerFailures, cooldown: c.cfg.BreakerCooldown}
+		c.breakers[host] = b
+		circuitState.WithLabelValues(host).Set(float64(breakerClosed))
+	}
+	return b
+}
+
+// Get fetches url, see Do.
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req with a timeout per attempt and retries idempotent requests.
+// Responses with retryable status codes are returned once the retries are
+// used up, so callers still check the status.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	breaker := c.breaker(host)
+
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += max(c.cfg.Retries, 0)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if !breaker.allow() {
+			requestsTotal.WithLabelValues(host, req.Method, "circuit_open").Inc()
+			return nil, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+		}
+
+		resp, err := c.attempt(req)
+		if err != nil && req.Context().Err() != nil {
+			// The caller gave up, that says nothing about the upstream.
+			breaker.abort()
+			return nil, err
+		}
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		breaker.record(!failed)
+
+		last := attempt+1 >= attempts
+		if last || !retryable(req.Context(), resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := backoff(c.cfg.RetryBackoff, attempt)
+		slog.DebugContext(req.Context(), "Retrying upstream request", "upstream", host, "url", req.URL.String(), "attempt", attempt+1, "retry_in", delay.String(), "error", err)
+		retriesTotal.WithLabelValues(host).Inc()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.cfg.Timeout)
+	attemptReq := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(attemptReq)
+	requestDuration.WithLabelValues(req.URL.Host, req.Method).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		cancel()
+		requestsTotal.WithLabelValues(req.URL.Host, req.Method, "error").Inc()
+		return nil, err
+	}
+	requestsTotal.WithLabelValues(req.URL.Host, req.Method, strconv.Itoa(resp.StatusCode)).Inc()
+
+	// The timeout keeps running until the caller has read the body.
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// isIdempotent reports whether req may be sent again, which also needs a
+// body that can be replayed. DELETE is idempotent too, but a retry after a
+// lost response answers 404 for a delete that worked.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << min(attempt, 10)
+	// Jitter, so clients don't retry in lockstep.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// circuitBreaker tracks the failures of a single upstream host.
+type circuitBreaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if ok {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// abort ends an attempt without an outcome.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	level := slog.LevelWarn
+	if state == breakerClosed {
+		level = slog.LevelInfo
+	}
+	slog.Log(context.Background(), level, "Upstream circuit breaker changed state", "upstream", b.host, "from", b.state.String(), "to", state.String())
+	b.state = state
+	circuitState.WithLabelValues(b.host).Set(float64(state))
+}
@@ -0,0 +1,188 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		op    string // allow, ok, fail, abort or cooldown
+		allow bool   // the result of allow
+		state breakerState
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []step{
+				{op: "fail", state: breakerClosed},
+				{op: "fail", state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "success resets the failures",
+			steps: []step{
+				{op: "fail", state: breakerClosed},
+				{op: "fail", state: breakerClosed},
+				{op: "ok", state: breakerClosed},
+				{op: "fail", state: breakerClosed},
+				{op: "fail", state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "opens at the threshold",
+			steps: []step{
+				{op: "fail", state: breakerClosed},
+				{op: "fail", state: breakerClosed},
+				{op: "fail", state: breakerOpen},
+				{op: "allow", allow: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "lets one probe through after the cooldown",
+			steps: []step{
+				{op: "fail"}, {op: "fail"}, {op: "fail", state: breakerOpen},
+				{op: "cooldown", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "allow", allow: false, state: breakerHalfOpen},
+			},
+		},
+		{
+			name: "successful probe closes",
+			steps: []step{
+				{op: "fail"}, {op: "fail"}, {op: "fail", state: breakerOpen},
+				{op: "cooldown", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "ok", state: breakerClosed},
+				{op: "allow", allow: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "failed probe opens again",
+			steps: []step{
+				{op: "fail"}, {op: "fail"}, {op: "fail", state: breakerOpen},
+				{op: "cooldown", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "fail", state: breakerOpen},
+				{op: "allow", allow: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "aborted probe lets the next one through",
+			steps: []step{
+				{op: "fail"}, {op: "fail"}, {op: "fail", state: breakerOpen},
+				{op: "cooldown", state: breakerOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+				{op: "abort", state: breakerHalfOpen},
+				{op: "allow", allow: true, state: breakerHalfOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &circuitBreaker{host: "test", threshold: 3, cooldown: time.Minute}
+			for i, s := range tt.steps {
+				switch s.op {
+				case "allow":
+					if got := b.allow(); got != s.allow {
+						t.Fatalf("step %d: allow() = %v, want %v", i, got, s.allow)
+					}
+				case "ok":
+					b.record(true)
+				case "fail":
+					b.record(false)
+				case "abort":
+					b.abort()
+				case "cooldown":
+					b.openedAt = time.Now().Add(-b.cooldown)
+				}
+				if b.state != s.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, s.op, b.state, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		wantHits int32
+	}{
+		{name: "GET is retried", method: http.MethodGet, status: http.StatusServiceUnavailable, wantHits: 3},
+		{name: "PUT is retried", method: http.MethodPut, status: http.StatusBadGateway, wantHits: 3},
+		{name: "DELETE is not retried", method: http.MethodDelete, status: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "POST is not retried", method: http.MethodPost, status: http.StatusServiceUnavailable, wantHits: 1},
+		{name: "client errors are not retried", method: http.MethodGet, status: http.StatusNotFound, wantHits: 1},
+		{name: "server errors other than 502, 503 and 504 are not retried", method: http.MethodGet, status: http.StatusInternalServerError, wantHits: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			c := NewClient(Config{Timeout: time.Second, Retries: 2, RetryBackoff: time.Millisecond, BreakerFailures: 10, BreakerCooldown: time.Minute}, srv.Client())
+			req, err := http.NewRequestWithContext(context.Background(), tt.method, srv.URL, strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatalf("Do() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream got %d requests, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestClientCircuitOpen(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := NewClient(Config{Timeout: time.Second, Retries: 0, BreakerFailures: 2, BreakerCooldown: time.Minute}, srv.Client())
+	for range 2 {
+		resp, err := c.Get(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if _, err := c.Get(context.Background(), srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Get() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream got %d requests, want 2", got)
+	}
+}
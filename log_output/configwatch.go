@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	infoFileName    = "information.txt"
+	messageFileName = "MESSAGE"
+	maxInfoSize     = 64 << 10
+	maxMessageSize  = 1 << 10
+	// reloadDebounce groups the events of a single ConfigMap update.
+	reloadDebounce = 100 * time.Millisecond
+)
+
+// mountedConfig is one validated version of the log-output ConfigMap.
+type mountedConfig struct {
+	Message     string
+	Information string
+	// Version is a hash of the content, so it only changes with it.
+	Version  string
+	LoadedAt time.Time
+}
+
+// configWatcher keeps the ConfigMap mounted in dir in memory and reloads it
+// when the volume changes. Kubernetes never edits the files in place: it
+// writes a new timestamped directory and swaps the ..data symlink to it.
+type configWatcher struct {
+	dir string
+	// defaultMessage is used when the ConfigMap has no MESSAGE key.
+	defaultMessage string
+
+	mu        sync.RWMutex
+	current   *mountedConfig
+	reloads   int
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func newConfigWatcher(dir, defaultMessage string) *configWatcher {
+	w := &configWatcher{dir: dir, defaultMessage: defaultMessage}
+	w.reload()
+	return w
+}
+
+// Current returns the latest valid config, or nil if none was loaded yet.
+func (w *configWatcher) Current() *mountedConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.current
+}
+
+func (w *configWatcher) load() (*mountedConfig, error) {
+	info, err := readConfigFile(filepath.Join(w.dir, infoFileName), maxInfoSize)
+	if err != nil {
+		return nil, err
+	}
+
+	message := w.defaultMessage
+	data, err := readConfigFile(filepath.Join(w.dir, messageFileName), maxMessageSize)
+	switch {
+	case err == nil:
+		message = strings.TrimSpace(data)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	if strings.ContainsAny(message, "\r\n") {
+		return nil, fmt.Errorf("%s must be a single line", messageFileName)
+	}
+
+	sum := sha256.Sum256([]byte(message + "\x00" + info))
+	return &mountedConfig{
+		Message:     message,
+		Information: info,
+		Version:     hex.EncodeToString(sum[:6]),
+		LoadedAt:    time.Now().UTC(),
+	}, nil
+}
+
+func readConfigFile(path string, limit int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if int64(len(data)) > limit {
+		return "", fmt.Errorf("%s is larger than %d bytes", path, limit)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("%s is not valid UTF-8", path)
+	}
+	return string(data), nil
+}
+
+// reload replaces the config if the files changed. An invalid update is
+// rejected and the previous version kept.
+func (w *configWatcher) reload() {
+	cfg, err := w.load()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err != nil {
+		w.lastErr, w.lastErrAt = err, time.Now().UTC()
+		slog.Error("Invalid config, keeping the previous version", "dir", w.dir, "version", w.versionLocked(), "error", err)
+		return
+	}
+	w.lastErr = nil
+
+	if w.current != nil && w.current.Version == cfg.Version {
+		return
+	}
+	previous := w.versionLocked()
+	if w.current != nil {
+		w.reloads++
+	}
+	w.current = cfg
+	slog.Info("Loaded config", "dir", w.dir, "version", cfg.Version, "previous_version", previous, "reloads", w.reloads)
+}
+
+func (w *configWatcher) versionLocked() string {
+	if w.current == nil {
+		return ""
+	}
+	return w.current.Version
+}
+
+// Watch reloads the config whenever dir changes, until ctx is done.
+func (w *configWatcher) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// The directory is watched rather than the files, as the symlinks are
+	// replaced, not written to.
+	if err := watcher.Add(w.dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", w.dir, err)
+	}
+	slog.Info("Watching config for changes", "dir", w.dir)
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if isConfigEvent(event) {
+				slog.Debug("Config changed", "file", event.Name, "op", event.Op.String())
+				debounce = time.After(reloadDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Config watcher error", "error", err)
+		case <-debounce:
+			debounce = nil
+			w.reload()
+		}
+	}
+}
+
+// isConfigEvent picks the ..data symlink swap of a ConfigMap update, and
+// plain edits of the files when running outside of Kubernetes.
+func isConfigEvent(event fsnotify.Event) bool {
+	switch filepath.Base(event.Name) {
+	case "..data", infoFileName, messageFileName:
+		return event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)
+	}
+	return false
+}
+
+// Check fails while the latest update is invalid. It is an optional
+// readiness check, as the previous version keeps being served.
+func (w *configWatcher) Check(context.Context) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.lastErr != nil {
+		return w.lastErr
+	}
+	if w.current == nil {
+		return fmt.Errorf("config not loaded")
+	}
+	return nil
+}
+
+type configStatus struct {
+	Dir         string     `json:"dir"`
+	Version     string     `json:"version,omitempty"`
+	LoadedAt    *time.Time `json:"loaded_at,omitempty"`
+	Reloads     int        `json:"reloads"`
+	Message     string     `json:"message"`
+	Information string     `json:"information"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// handleConfig serves the config in use and when it was last reloaded.
+func (w *configWatcher) handleConfig(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.mu.RLock()
+	status := configStatus{Dir: w.dir, Reloads: w.reloads}
+	if w.current != nil {
+		status.Version = w.current.Version
+		status.LoadedAt = &w.current.LoadedAt
+		status.Message = w.current.Message
+		status.Information = w.current.Information
+	}
+	if w.lastErr != nil {
+		lastErrAt := w.lastErrAt
+		status.LastError = w.lastErr.Error()
+		status.LastErrorAt = &lastErrAt
+	}
+	w.mu.RUnlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding config status", "error", err)
+	}
+}
@@ -1,3 +1,9 @@
 module greeter
 
 go 1.25.3
+
+require github.com/kirillstrelkov/KubernetesSubmissions/common v0.0.0
+
+require gopkg.in/yaml.v3 v3.0.1 // indirect
+
+replace github.com/kirillstrelkov/KubernetesSubmissions/common => ../../common
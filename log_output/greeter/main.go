@@ -2,22 +2,31 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
 )
 
+// Config is the greeter configuration, loaded by the config package.
+type Config struct {
+	Port    string `env:"PORT" yaml:"port" default:"8080" validate:"port"`
+	Message string `env:"MSG" yaml:"message" default:"Hello"`
+}
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	logging.Setup("greeter")
+
+	var cfg Config
+	config.MustLoad(&cfg, os.Args[1:])
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		msg := os.Getenv("MSG")
-		if msg == "" {
-			msg = "Hello"
-		}
-		fmt.Fprintf(w, "%s", msg)
+		fmt.Fprintf(w, "%s", cfg.Message)
 	})
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	slog.Info("Server started", "port", cfg.Port)
+	err := http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), logging.Requests(http.DefaultServeMux))
+	slog.Error("Server failed", "error", err)
+	os.Exit(1)
 }
@@ -1,31 +1,73 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/health"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/upstream"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Config is the log-output configuration, loaded by the config
+// package.
+type Config struct {
+	Port            string `env:"PORT" yaml:"port" default:"8080" validate:"port"`
+	PingPongService string `env:"PING_PONG_SERVICE" yaml:"ping_pong_service" default:"localhost:8080" validate:"hostport"`
+	GreeterService  string `env:"GREETER_SERVICE" yaml:"greeter_service" validate:"hostport"`
+	// ConfigDir is where the log-output ConfigMap is mounted.
+	ConfigDir string `env:"CONFIG_DIR" yaml:"config_dir" default:"/tmp"`
+	// Message is shown when the ConfigMap has no MESSAGE key.
+	Message  string          `env:"MESSAGE" yaml:"message"`
+	Upstream upstream.Config `yaml:"upstream"`
+	Health   health.Config   `yaml:"health"`
+	Shutdown shutdown.Config `yaml:"shutdown"`
+}
+
+var cfg Config
+
 var randomUUID string
 
+// upstreamClient is used for the calls to ping-pong and the greeter.
+var upstreamClient *upstream.Client
+
+// configMap holds the mounted ConfigMap and reloads it on changes.
+var configMap *configWatcher
+
+// shuttingDown fails the readiness check while the server drains.
+var shuttingDown atomic.Bool
+
 const iso8601Format = "2006-01-02T15:04:05.000Z"
 
-func getCounter() (string, error) {
-	svc := os.Getenv("PING_PONG_SERVICE")
-	if svc == "" {
-		svc = "localhost:8080"
+func pingPongURL() string {
+	return fmt.Sprintf("http://%s/pings", cfg.PingPongService)
+}
+
+func getCounter(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pingPongURL(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
 	}
-	url := fmt.Sprintf("http://%s/pings", svc)
 
-	resp, err := http.Get(url)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error making request: %v", err)
+		return "", fmt.Errorf("error making request: %w", err)
 	}
 
 	defer resp.Body.Close()
@@ -48,55 +90,70 @@ func getCounter() (string, error) {
 	return fmt.Sprintf("%d", counter), nil
 }
 func printConfigValues(w io.Writer) {
-	fs, err := os.Open("/tmp/information.txt")
-	if err != nil {
-		fmt.Fprintf(w, "Error opening file: %v\n", err)
+	current := configMap.Current()
+	if current == nil {
+		fmt.Fprintf(w, "Error loading config: %v\n", configMap.Check(context.Background()))
 		return
 	}
-	defer fs.Close()
 
-	content, err := io.ReadAll(fs)
-	if err != nil {
-		fmt.Fprintf(w, "Error reading file: %v\n", err)
-		return
-	}
-
-	msg := os.Getenv("MESSAGE")
-	fmt.Fprintf(w, "file content: %s\n", content)
-	fmt.Fprintf(w, "env variable: MESSAGE=%s\n", msg)
+	fmt.Fprintf(w, "file content: %s\n", current.Information)
+	fmt.Fprintf(w, "env variable: MESSAGE=%s\n", current.Message)
 }
 
 func main() {
-	printConfigValues(os.Stdout)
+	logging.Setup("log-output")
+	config.MustLoad(&cfg, os.Args[1:])
+
+	if err := run(); err != nil {
+		slog.Error("HTTP server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	configMap = newConfigWatcher(cfg.ConfigDir, cfg.Message)
+	upstreamClient = upstream.NewClient(cfg.Upstream, &http.Client{})
 
 	randomUUID = uuid.New().String()
-	fmt.Printf("Startup: Generated and stored UUID: %s\n", randomUUID)
+	slog.Info("Generated and stored UUID", "uuid", randomUUID)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	addr := ":" + port
+	addr := ":" + cfg.Port
 
 	http.HandleFunc("/", statusHandler)
-	http.HandleFunc("/healthz", statusAlive)
-
-	fmt.Printf("HTTP server starting on port %s\n", port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("HTTP server failed: %v", err)
-	}
+	checker := health.NewChecker(cfg.Health, &shuttingDown,
+		health.Check{Name: "ping-pong", Check: checkPingPong},
+		health.Check{Name: "greeter", Optional: true, Check: checkGreeter},
+		health.Check{Name: "config", Optional: true, Check: configMap.Check},
+	)
+	http.HandleFunc("/livez", checker.HandleLive)
+	http.HandleFunc("/readyz", checker.HandleReady)
+	http.HandleFunc("/healthz", checker.HandleReady)
+
+	http.HandleFunc("/config", configMap.handleConfig)
+	http.Handle("/metrics", promhttp.Handler())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := configMap.Watch(ctx); err != nil {
+			slog.Error("Config changes won't be picked up", "error", err)
+		}
+	}()
+
+	slog.Info("HTTP server starting", "port", cfg.Port)
+	srv := &http.Server{Addr: addr, Handler: logging.Requests(http.DefaultServeMux)}
+	return shutdown.Serve(ctx, srv, cfg.Shutdown, func() { shuttingDown.Store(true) })
 }
 
-func statusAlive(w http.ResponseWriter, r *http.Request) {
-	if _, err := getCounter(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "service is not running: %s\n", err)
-		return
-	}
+func checkPingPong(ctx context.Context) error {
+	_, err := getCounter(ctx)
+	return err
+}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Printf("Alive\n")
+func checkGreeter(ctx context.Context) error {
+	_, err := getGreeterMessage(ctx)
+	return err
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -117,40 +174,59 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp := nowUTC.Format(iso8601Format)
 
 	line := fmt.Sprintf("%s: %s\n", timestamp, randomUUID)
-	counter, _ := getCounter()
-	// print
-	fmt.Print(line)
-	fmt.Printf("Ping / Pongs: %s\n", counter)
+	counter, err := getCounter(r.Context())
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error getting ping-pong counter", "error", err)
+		counter = unavailable(err)
+	}
+	slog.InfoContext(r.Context(), "Status", "timestamp", timestamp, "uuid", randomUUID, "pings", counter)
+
+	msg, err := getGreeterMessage(r.Context())
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error getting greeting", "error", err)
+		msg = unavailable(err)
+	}
 
 	// html out
 	fmt.Fprintln(w, line)
 	fmt.Fprintf(w, "Ping / Pongs: %s\n", counter)
 	printConfigValues(w)
-
-	msg := getGreeterMessage()
 	fmt.Fprintf(w, "greetings: %s\n", msg)
 }
 
-func getGreeterMessage() string {
-	svc := os.Getenv("GREETER_SERVICE")
-	if svc == "" {
-		return "GREETER_SERVICE not set"
+// unavailable is shown in place of a value a dependency failed to deliver.
+func unavailable(err error) string {
+	return fmt.Sprintf("unavailable (degraded: %v)", err)
+}
+
+func getGreeterMessage(ctx context.Context) (string, error) {
+	if cfg.GreeterService == "" {
+		return "", fmt.Errorf("GREETER_SERVICE not set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/", cfg.GreeterService), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
 	}
-	resp, err := http.Get(fmt.Sprintf("http://%s/", svc))
+
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
-		return fmt.Sprintf("error making request: %v", err)
+		return "", fmt.Errorf("error making request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Sprintf("received non-OK status code: %d", resp.StatusCode)
+		return "", fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Sprintf("error reading response body: %v", err)
+		return "", fmt.Errorf("error reading response body: %w", err)
 	}
 
-	return string(body)
+	return string(body), nil
 }
@@ -1,27 +1,47 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/database"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/health"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/metrics"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Config is the ping-pong configuration, loaded by the config package.
+type Config struct {
+	Port     string          `env:"PORT" yaml:"port" default:"8080" validate:"port"`
+	DB       database.Config `yaml:"db"`
+	Health   health.Config   `yaml:"health"`
+	Shutdown shutdown.Config `yaml:"shutdown"`
+}
+
 type MyHandler struct {
-	Db   *sql.DB
-	dbMu sync.RWMutex
+	DB           *database.Manager
+	shuttingDown atomic.Bool
 }
 
 func (h *MyHandler) handler(w http.ResponseWriter, r *http.Request) {
 	count, err := h.getCounter()
 	if err != nil {
-		log.Printf("Error getting counter: %v\n", err)
+		slog.ErrorContext(r.Context(), "Error getting counter", "error", err)
 		http.Error(w, "Failed to get counter", http.StatusInternalServerError)
 		return
 	}
@@ -30,7 +50,7 @@ func (h *MyHandler) handler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	err = h.incrementCounter()
 	if err != nil {
-		log.Printf("Error incrementing counter: %v\n", err)
+		slog.ErrorContext(r.Context(), "Error incrementing counter", "error", err)
 		http.Error(w, "Failed to increment counter", http.StatusInternalServerError)
 		return
 	}
@@ -41,7 +61,7 @@ func (h *MyHandler) handler(w http.ResponseWriter, r *http.Request) {
 func (h *MyHandler) handlerPings(w http.ResponseWriter, r *http.Request) {
 	count, err := h.getCounter()
 	if err != nil {
-		log.Printf("Error getting counter: %v\n", err)
+		slog.ErrorContext(r.Context(), "Error getting counter", "error", err)
 		http.Error(w, "Failed to get counter", http.StatusInternalServerError)
 		return
 	}
@@ -51,22 +71,11 @@ func (h *MyHandler) handlerPings(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%d", count)
 }
 
-func (h *MyHandler) handlerAlive(w http.ResponseWriter, r *http.Request) {
-	if h.Db == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "database not connected\n")
-		return
-	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "alive\n")
-}
-
 func handleStress(w http.ResponseWriter, _ *http.Request) {
 	cores := runtime.NumCPU()
 	duration := 60 * time.Second
 
-	fmt.Printf("Starting stress test on %d cores for %v\n", cores, duration)
+	slog.Info("Starting stress test", "cores", cores, "duration", duration.String())
 
 	done := make(chan bool)
 
@@ -90,103 +99,100 @@ func handleStress(w http.ResponseWriter, _ *http.Request) {
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	logging.Setup("ping-pong-app")
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		// The migration Job shares the config of the service.
+		var cfg Config
+		args := config.MustLoad(&cfg, os.Args[2:])
+		if err := migrator.RunCommand(cfg.DB, args); err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	h := &MyHandler{Db: nil}
+	var cfg Config
+	config.MustLoad(&cfg, os.Args[1:])
 
-	go func() {
-		log.Println("Waiting 15 seconds to connect to database...")
-		time.Sleep(15 * time.Second)
+	if err := run(cfg); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
 
-		db, err := connectToDB()
-		if err != nil {
-			log.Fatalf("Failed to connect to DB after delay: %v", err)
-		}
+func run(cfg Config) error {
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		err = initDatabase(db)
-		if err != nil {
-			log.Fatalf("Failed to initialize database after delay: %v", err)
-		}
+	// ctx is also cancelled if the database can't be reached in time.
+	ctx, fail := context.WithCancelCause(sigCtx)
+	defer fail(nil)
 
-		h.dbMu.Lock()
-		h.Db = db
-		h.dbMu.Unlock()
-		log.Println("Database connected and initialized.")
-	}()
+	h := &MyHandler{DB: database.NewManager(cfg.DB, initDatabase)}
 
-	defer func() {
-		h.dbMu.RLock()
-		dbToClose := h.Db
-		h.dbMu.RUnlock()
-		if dbToClose != nil {
-			if err := dbToClose.Close(); err != nil {
-				log.Printf("Error closing database connection: %v", err)
-			}
+	go func() {
+		connectCtx, cancel := context.WithTimeout(ctx, cfg.DB.ConnectTimeout)
+		defer cancel()
+
+		if err := h.DB.Connect(connectCtx); err != nil {
+			fail(err)
+			return
 		}
+		h.DB.Watch(ctx)
 	}()
+	defer h.DB.Close()
 
-	addr := ":" + port
+	addr := ":" + cfg.Port
 
-	fmt.Printf("Server v2 started in port %s\n", port)
+	slog.Info("Server v2 started", "port", cfg.Port)
 
 	http.HandleFunc("/pings", h.handlerPings)
 	http.HandleFunc("/", h.handler)
-	http.HandleFunc("/healthz", h.handlerAlive)
+	checker := health.NewChecker(cfg.Health, &h.shuttingDown,
+		health.Check{Name: "database", Check: h.DB.Check},
+	)
+	http.HandleFunc("/livez", checker.HandleLive)
+	http.HandleFunc("/readyz", checker.HandleReady)
+	http.HandleFunc("/healthz", checker.HandleReady)
 	http.HandleFunc("/stress", handleStress)
 
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
+	prometheus.MustRegister(counterCollector{h: h})
+	http.Handle("/metrics", promhttp.Handler())
 
-func connectToDB() (*sql.DB, error) {
-	connStr := os.Getenv("DB_URL")
-	if connStr == "" {
-		panic("DB_URL is not set")
-	}
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
+	srv := &http.Server{Addr: addr, Handler: logging.Requests(metrics.Requests(http.DefaultServeMux))}
+	if err := shutdown.Serve(ctx, srv, cfg.Shutdown, func() { h.shuttingDown.Store(true) }); err != nil {
+		return err
 	}
-	err = db.Ping()
-	if err != nil {
-		return nil, err
+
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		return cause
 	}
-	return db, nil
+	return nil
 }
 
-func initDatabase(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS counters (
-			id SERIAL PRIMARY KEY,
-			count INTEGER DEFAULT 0
-		);
-		INSERT INTO counters (count) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM counters);
-	`)
-	return err
+func initDatabase(ctx context.Context, db *sql.DB) error {
+	return migrator.Up(ctx, db)
 }
 
 func (h *MyHandler) incrementCounter() error {
-	h.dbMu.RLock()
-	db := h.Db
-	h.dbMu.RUnlock()
+	db := h.DB.DB()
 
 	if db == nil {
 		return fmt.Errorf("database not connected")
 	}
+	defer observeQuery("increment_counter", time.Now())
 	_, err := db.Exec("UPDATE counters SET count = count + 1 WHERE id = 1")
 	return err
 }
 
 func (h *MyHandler) getCounter() (int, error) {
-	h.dbMu.RLock()
-	db := h.Db
-	h.dbMu.RUnlock()
+	db := h.DB.DB()
 
 	if db == nil {
 		return 0, fmt.Errorf("database not connected")
 	}
+	defer observeQuery("get_counter", time.Now())
 	var count int
 	row := db.QueryRow("SELECT count FROM counters WHERE id = 1")
 	err := row.Scan(&count)
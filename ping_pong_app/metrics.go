@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Database query latency by query.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query"})
+
+	pingPongCounterDesc = prometheus.NewDesc(
+		"pingpong_counter",
+		"Current value of the ping-pong counter.",
+		nil, nil,
+	)
+)
+
+// observeQuery records the time since start under the given query name.
+func observeQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// counterCollector reads the counter from the database on every scrape, as
+// it is shared by all replicas.
+type counterCollector struct {
+	h *MyHandler
+}
+
+func (c counterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pingPongCounterDesc
+}
+
+func (c counterCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.h.DB.DB() == nil {
+		return
+	}
+
+	count, err := c.h.getCounter()
+	if err != nil {
+		slog.Error("Error reading counter for metrics", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(pingPongCounterDesc, prometheus.GaugeValue, float64(count))
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/database"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrator applies the schema of the ping-pong app. Its lock ID must
+// differ from those of the other services sharing the database.
+var migrator = &database.Migrator{
+	Service: "ping-pong-app",
+	LockID:  7346012,
+	FS:      migrationsFS,
+	Dir:     "migrations",
+}
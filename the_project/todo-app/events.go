@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// todosStream is declared by todo-backend, which publishes the todo
+	// events.
+	todosStream = "TODOS"
+	// eventRetry is how long browsers wait before reconnecting a dropped
+	// event stream.
+	eventRetry = 3 * time.Second
+	// subscriberBuffer is how far a browser may fall behind before its
+	// stream is closed. It catches up from the replay when it reconnects.
+	subscriberBuffer = 32
+	// consumeRetryDelay is the pause between attempts to start consuming,
+	// e.g. while the stream doesn't exist yet.
+	consumeRetryDelay = 5 * time.Second
+)
+
+var todoSubjects = []string{"todo.created", "todo.updated", "todo.deleted"}
+
+var (
+	eventClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "event_stream_clients",
+		Help: "Browsers connected to /events.",
+	})
+
+	eventsSentTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "event_stream_events_total",
+		Help: "Events sent to browsers by type.",
+	}, []string{"type"})
+)
+
+// eventsConfig is the section of the service configuration for the live
+// updates of the todo lists.
+type eventsConfig struct {
+	// NATSURL is the NATS server todo-backend publishes the todo events
+	// to. Without it the page polls for changes.
+	NATSURL string `env:"NATS_URL" yaml:"nats_url" validate:"url"`
+	// Heartbeat keeps idle streams from being closed by proxies.
+	Heartbeat time.Duration `env:"EVENTS_HEARTBEAT" yaml:"heartbeat" default:"15s"`
+	// Replay is how many of the last events are kept for browsers that
+	// reconnect.
+	Replay int `env:"EVENTS_REPLAY" yaml:"replay" default:"256"`
+	// PollInterval is how often the page reloads the lists while live
+	// updates are unavailable.
+	PollInterval time.Duration `env:"EVENTS_POLL_INTERVAL" yaml:"poll_interval" default:"30s"`
+}
+
+func (c eventsConfig) validate() []string {
+	var problems []string
+	if c.Heartbeat <= 0 {
+		problems = append(problems, "EVENTS_HEARTBEAT: must be positive")
+	}
+	if c.Replay < 1 {
+		problems = append(problems, "EVENTS_REPLAY: must be at least 1")
+	}
+	if c.PollInterval < time.Second {
+		problems = append(problems, "EVENTS_POLL_INTERVAL: must be at least 1s")
+	}
+	return problems
+}
+
+// todoEvent is a change of a todo as sent to browsers.
+type todoEvent struct {
+	// Seq is the sequence of the message in the TODOS stream. It is the same
+	// on every replica, so it serves as the event ID.
+	Seq   uint64
+	Type  string
+	Owner string
+	Data  []byte
+}
+
+type eventSubscriber struct {
+	user string
+	// after is the last event the browser has, older ones are not sent.
+	after  uint64
+	events chan todoEvent
+}
+
+// eventHub consumes the todo events from JetStream and fans them out to the
+// event streams of the browsers, each only getting the todos of its user.
+type eventHub struct {
+	cfg eventsConfig
+
+	mu        sync.Mutex
+	nc        *nats.Conn
+	consuming bool
+	closed    bool
+	// recent are the last events, oldest first. Events up to since are no
+	// longer known, a browser that has an older one has to reload.
+	recent      []todoEvent
+	since, last uint64
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventHub(cfg eventsConfig) *eventHub {
+	return &eventHub{cfg: cfg, subscribers: map[*eventSubscriber]struct{}{}}
+}
+
+// run consumes the todo events until ctx is cancelled. NATS may not be
+// reachable at startup, so connecting and consuming are retried in the
+// background; browsers poll meanwhile.
+func (e *eventHub) run(ctx context.Context) {
+	if e.cfg.NATSURL == "" {
+		slog.Info("NATS_URL is not set, live updates are disabled and the page polls for changes")
+		return
+	}
+
+	slog.Info("Connecting to NATS", "url", e.cfg.NATSURL)
+	nc, err := nats.Connect(e.cfg.NATSURL,
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// err is nil when the connection is closed on shutdown.
+			if err != nil {
+				slog.Warn("Disconnected from NATS, browsers poll until it is back", "error", err)
+			}
+			e.dropAll()
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		slog.Warn("Failed to connect to NATS, live updates are disabled", "error", err)
+		return
+	}
+	defer nc.Close()
+
+	e.mu.Lock()
+	e.nc = nc
+	e.mu.Unlock()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		slog.Warn("Failed to create JetStream context, live updates are disabled", "error", err)
+		return
+	}
+
+	var consumeCtx jetstream.ConsumeContext
+	for {
+		consumeCtx, err = e.consume(ctx, js)
+		if err == nil {
+			break
+		}
+		slog.Warn("Failed to consume todo events, retrying", "error", err, "retry_in", consumeRetryDelay.String())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(consumeRetryDelay):
+		}
+	}
+	defer consumeCtx.Stop()
+
+	slog.Info("Consuming todo events", "subjects", todoSubjects, "stream", todosStream)
+	<-ctx.Done()
+}
+
+// consume starts an ordered consumer right after the current end of the
+// stream. It resumes on its own after reconnects, so no event is skipped.
+func (e *eventHub) consume(ctx context.Context, js jetstream.JetStream) (jetstream.ConsumeContext, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := js.Stream(ctx, todosStream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up stream %s: %w", todosStream, err)
+	}
+	start := stream.CachedInfo().State.LastSeq
+
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: todoSubjects,
+		DeliverPolicy:  jetstream.DeliverByStartSequencePolicy,
+		OptStartSeq:    start + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+
+	consumeCtx, err := consumer.Consume(e.handleMessage,
+		jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+			slog.Warn("Error consuming todo events", "error", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.since, e.last = start, start
+	e.consuming = true
+	e.mu.Unlock()
+	return consumeCtx, nil
+}
+
+func (e *eventHub) handleMessage(msg jetstream.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		slog.Warn("Error reading todo event metadata", "subject", msg.Subject(), "error", err)
+		return
+	}
+
+	var todo struct {
+		Post
+		Owner string `json:"owner"`
+	}
+	if err := json.Unmarshal(msg.Data(), &todo); err != nil {
+		slog.Warn("Error unmarshalling todo event", "subject", msg.Subject(), "seq", meta.Sequence.Stream, "error", err)
+		return
+	}
+	// The owner is only used for routing, browsers get the todo itself.
+	data, err := json.Marshal(todo.Post)
+	if err != nil {
+		slog.Warn("Error marshalling todo event", "subject", msg.Subject(), "error", err)
+		return
+	}
+
+	e.publish(todoEvent{
+		Seq:   meta.Sequence.Stream,
+		Type:  strings.TrimPrefix(msg.Subject(), "todo."),
+		Owner: todo.Owner,
+		Data:  data,
+	})
+}
+
+func (e *eventHub) publish(ev todoEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.recent = append(e.recent, ev)
+	if drop := len(e.recent) - e.cfg.Replay; drop > 0 {
+		e.since = e.recent[drop-1].Seq
+		e.recent = append(e.recent[:0], e.recent[drop:]...)
+	}
+	e.last = ev.Seq
+
+	for sub := range e.subscribers {
+		if sub.user != ev.Owner || ev.Seq <= sub.after {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			slog.Info("Closing event stream of a browser that fell behind", "user", sub.user)
+			e.dropLocked(sub)
+		}
+	}
+}
+
+// live reports whether events are being consumed.
+func (e *eventHub) live() bool {
+	return e.consuming && !e.closed && e.nc.IsConnected()
+}
+
+// position is the ID of the last event, "" while live updates are
+// unavailable. The page passes it on when it connects, so changes made
+// after it was rendered are replayed.
+func (e *eventHub) position() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.live() {
+		return ""
+	}
+	return strconv.FormatUint(e.last, 10)
+}
+
+// subscribe registers a browser of user that has seen the events up to
+// lastID. It returns the events it missed, or complete false if they are no
+// longer known and it has to reload the lists. ok is false while live
+// updates are unavailable.
+func (e *eventHub) subscribe(user string, lastID uint64, hasLastID bool) (sub *eventSubscriber, missed []todoEvent, complete, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.live() {
+		return nil, nil, false, false
+	}
+
+	sub = &eventSubscriber{user: user, after: e.last, events: make(chan todoEvent, subscriberBuffer)}
+	e.subscribers[sub] = struct{}{}
+	eventClients.Inc()
+
+	if !hasLastID {
+		return sub, nil, true, true
+	}
+	if lastID < e.since {
+		return sub, nil, false, true
+	}
+	for _, ev := range e.recent {
+		if ev.Seq > lastID && ev.Owner == user {
+			missed = append(missed, ev)
+		}
+	}
+	// A browser that is ahead got the events from another replica.
+	sub.after = max(sub.after, lastID)
+	return sub, missed, true, true
+}
+
+func (e *eventHub) unsubscribe(sub *eventSubscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dropLocked(sub)
+}
+
+func (e *eventHub) dropLocked(sub *eventSubscriber) {
+	if _, ok := e.subscribers[sub]; !ok {
+		return
+	}
+	delete(e.subscribers, sub)
+	close(sub.events)
+	eventClients.Dec()
+}
+
+// dropAll closes all event streams. Browsers reconnect and fall back to
+// polling until live updates are available again.
+func (e *eventHub) dropAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for sub := range e.subscribers {
+		e.dropLocked(sub)
+	}
+}
+
+// Close ends all event streams, which would otherwise hold up the graceful
+// shutdown until its timeout.
+func (e *eventHub) Close() {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.dropAll()
+}
+
+// Check is the readiness check for NATS.
+func (e *eventHub) Check(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case e.nc == nil:
+		return errors.New("not connected to NATS")
+	case !e.nc.IsConnected():
+		return fmt.Errorf("NATS connection is %s", e.nc.Status())
+	case !e.consuming:
+		return errors.New("not consuming todo events yet")
+	}
+	return nil
+}
+
+// lastEventID is the last event the browser has: the Last-Event-ID header
+// EventSource sends when it reconnects, or last_event_id from the page on
+// the first connect.
+func lastEventID(r *http.Request) (uint64, bool) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	return id, err == nil
+}
+
+func writeEvent(w io.Writer, id uint64, event string, data []byte) error {
+	var b bytes.Buffer
+	if id > 0 {
+		fmt.Fprintf(&b, "id: %d\n", id)
+	}
+	fmt.Fprintf(&b, "event: %s\ndata: %s\n\n", event, data)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// eventsHandler streams the changes of the user's todos as server-sent
+// events: created, updated and deleted with the todo as data. ready starts
+// a live stream, resync asks the page to reload the lists because events
+// were missed, and poll tells it to poll while live updates are
+// unavailable.
+func (h *MyHandler) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.whoAmI(r.Context(), h.sessionToken(r))
+	if errors.Is(err, errUnauthorized) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error checking user for event stream", "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+
+	lastID, hasLastID := lastEventID(r)
+	sub, missed, complete, ok := h.Events.subscribe(user, lastID, hasLastID)
+	if !ok {
+		// EventSource reconnects after the retry, by then live updates may be
+		// back.
+		interval := h.Config.Events.PollInterval.Milliseconds()
+		fmt.Fprintf(w, "retry: %d\n\n", interval)
+		writeEvent(w, 0, "poll", fmt.Appendf(nil, `{"interval":%d}`, interval))
+		eventsSentTotal.WithLabelValues("poll").Inc()
+		return
+	}
+	defer h.Events.unsubscribe(sub)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if complete {
+		writeEvent(w, 0, "ready", []byte("{}"))
+		eventsSentTotal.WithLabelValues("ready").Inc()
+	} else {
+		slog.InfoContext(r.Context(), "Missed events are no longer known, browser reloads the lists", "last_event_id", lastID)
+		writeEvent(w, sub.after, "resync", []byte("{}"))
+		eventsSentTotal.WithLabelValues("resync").Inc()
+	}
+	for _, ev := range missed {
+		writeEvent(w, ev.Seq, ev.Type, ev.Data)
+		eventsSentTotal.WithLabelValues(ev.Type).Inc()
+	}
+	if err := rc.Flush(); err != nil {
+		slog.WarnContext(r.Context(), "Event stream can't be flushed", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(h.Config.Events.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, ev.Seq, ev.Type, ev.Data); err != nil {
+				return
+			}
+			eventsSentTotal.WithLabelValues(ev.Type).Inc()
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeNATS answers the NATS handshake and pings, enough for a connection
+// that stays connected.
+func fakeNATS(t *testing.T) *nats.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(`INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576}` + "\r\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					if strings.HasPrefix(scanner.Text(), "PING") {
+						conn.Write([]byte("PONG\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	nc, err := nats.Connect("nats://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// newLiveHub returns a hub that consumes from sequence start on, as after
+// consume.
+func newLiveHub(t *testing.T, replay int, start uint64) *eventHub {
+	t.Helper()
+	hub := newEventHub(eventsConfig{Replay: replay})
+	hub.nc = fakeNATS(t)
+	hub.consuming = true
+	hub.since, hub.last = start, start
+	return hub
+}
+
+func seqs(events []todoEvent) []uint64 {
+	var s []uint64
+	for _, ev := range events {
+		s = append(s, ev.Seq)
+	}
+	return s
+}
+
+// drain returns the events waiting for sub.
+func drain(sub *eventSubscriber) []todoEvent {
+	var events []todoEvent
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventHubSubscribe(t *testing.T) {
+	t.Run("unavailable", func(t *testing.T) {
+		hub := newEventHub(eventsConfig{Replay: 10})
+		if _, _, _, ok := hub.subscribe("alice", 0, false); ok {
+			t.Fatal("subscribe() ok = true before consuming")
+		}
+		if pos := hub.position(); pos != "" {
+			t.Errorf("position() = %q, want empty", pos)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		hub := newLiveHub(t, 10, 0)
+		hub.Close()
+		if _, _, _, ok := hub.subscribe("alice", 0, false); ok {
+			t.Fatal("subscribe() ok = true after Close")
+		}
+	})
+
+	t.Run("gets new events of its user", func(t *testing.T) {
+		hub := newLiveHub(t, 10, 4)
+		hub.publish(todoEvent{Seq: 5, Type: "created", Owner: "alice"})
+
+		sub, missed, complete, ok := hub.subscribe("alice", 0, false)
+		if !ok || !complete || len(missed) != 0 {
+			t.Fatalf("subscribe() = %v missed, complete %v, ok %v", seqs(missed), complete, ok)
+		}
+		if pos := hub.position(); pos != "5" {
+			t.Errorf("position() = %q, want 5", pos)
+		}
+
+		hub.publish(todoEvent{Seq: 6, Type: "created", Owner: "bob"})
+		hub.publish(todoEvent{Seq: 7, Type: "updated", Owner: "alice"})
+		if got := seqs(drain(sub)); len(got) != 1 || got[0] != 7 {
+			t.Errorf("received %v, want [7]", got)
+		}
+
+		hub.unsubscribe(sub)
+		if _, open := <-sub.events; open {
+			t.Error("events still open after unsubscribe")
+		}
+	})
+
+	t.Run("closed when it falls behind", func(t *testing.T) {
+		hub := newLiveHub(t, subscriberBuffer*2, 0)
+		sub, _, _, _ := hub.subscribe("alice", 0, false)
+		for i := range subscriberBuffer + 1 {
+			hub.publish(todoEvent{Seq: uint64(i + 1), Owner: "alice"})
+		}
+
+		if got := len(drain(sub)); got != subscriberBuffer {
+			t.Errorf("received %d events, want %d", got, subscriberBuffer)
+		}
+		if _, open := <-sub.events; open {
+			t.Error("events still open")
+		}
+		hub.unsubscribe(sub)
+	})
+}
+
+func TestEventHubReplay(t *testing.T) {
+	// The hub starts at 10 and keeps the last 4 events: 13 to 16. Event 12
+	// is the last one it no longer knows.
+	owners := map[uint64]string{11: "alice", 12: "alice", 13: "bob", 14: "alice", 15: "bob", 16: "alice"}
+
+	tests := []struct {
+		name         string
+		lastID       uint64
+		wantMissed   []uint64
+		wantComplete bool
+		// wantLive is what the subscriber gets of the next events 17
+		// (alice) and 18 (alice).
+		wantLive []uint64
+	}{
+		{name: "up to date", lastID: 16, wantComplete: true, wantLive: []uint64{17, 18}},
+		{name: "missed some", lastID: 13, wantMissed: []uint64{14, 16}, wantComplete: true, wantLive: []uint64{17, 18}},
+		{name: "oldest still known", lastID: 12, wantMissed: []uint64{14, 16}, wantComplete: true, wantLive: []uint64{17, 18}},
+		{name: "missed too many", lastID: 11, wantComplete: false, wantLive: []uint64{17, 18}},
+		{name: "ahead from another replica", lastID: 17, wantComplete: true, wantLive: []uint64{18}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newLiveHub(t, 4, 10)
+			for seq := uint64(11); seq <= 16; seq++ {
+				hub.publish(todoEvent{Seq: seq, Type: "updated", Owner: owners[seq]})
+			}
+
+			sub, missed, complete, ok := hub.subscribe("alice", tt.lastID, true)
+			if !ok {
+				t.Fatal("subscribe() ok = false")
+			}
+			defer hub.unsubscribe(sub)
+
+			if complete != tt.wantComplete {
+				t.Errorf("complete = %v, want %v", complete, tt.wantComplete)
+			}
+			if got := seqs(missed); !slices.Equal(got, tt.wantMissed) {
+				t.Errorf("missed = %v, want %v", got, tt.wantMissed)
+			}
+
+			hub.publish(todoEvent{Seq: 17, Type: "created", Owner: "alice"})
+			hub.publish(todoEvent{Seq: 18, Type: "created", Owner: "alice"})
+			if got := seqs(drain(sub)); !slices.Equal(got, tt.wantLive) {
+				t.Errorf("received %v, want %v", got, tt.wantLive)
+			}
+		})
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		wantID uint64
+		wantOK bool
+	}{
+		{name: "none"},
+		{name: "header", header: "42", wantID: 42, wantOK: true},
+		{name: "query", query: "?last_event_id=7", wantID: 7, wantOK: true},
+		{name: "header wins over query", header: "42", query: "?last_event_id=7", wantID: 42, wantOK: true},
+		{name: "invalid", header: "abc"},
+		{name: "negative", query: "?last_event_id=-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Last-Event-ID", tt.header)
+			}
+			id, ok := lastEventID(r)
+			if id != tt.wantID || ok != tt.wantOK {
+				t.Errorf("lastEventID() = %d, %v, want %d, %v", id, ok, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
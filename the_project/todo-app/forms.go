@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookie    = "todo_csrf"
+	csrfFormField = "csrf_token"
+	flashCookie   = "todo_flash"
+)
+
+// csrfToken returns the CSRF token of the browser and sets it as a cookie
+// on first use. Forms echo it in a hidden field, which other sites can't
+// read (double submit cookie).
+func (h *MyHandler) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token := rand.Text()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   h.Config.Session.Secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF rejects form submissions whose token doesn't match the cookie
+// with 403.
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	submitted := r.PostFormValue(csrfFormField)
+	if err == nil && cookie.Value != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(submitted)) == 1 {
+		return true
+	}
+
+	slog.WarnContext(r.Context(), "Rejected form without a valid CSRF token", "path", r.URL.Path)
+	http.Error(w, "Forbidden: invalid CSRF token, reload the page and try again", http.StatusForbidden)
+	return false
+}
+
+// Flash is a message shown once on the next page, after a redirect.
+type Flash struct {
+	// Kind is success or error.
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func setFlash(w http.ResponseWriter, kind, message string) {
+	raw, _ := json.Marshal(Flash{Kind: kind, Message: message})
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(raw),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// popFlash returns the pending flash message, if any, and clears it.
+func popFlash(w http.ResponseWriter, r *http.Request) *Flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+
+	raw, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	var flash Flash
+	if err := json.Unmarshal(raw, &flash); err != nil || flash.Message == "" {
+		return nil
+	}
+	return &flash
+}
+
+// returnTo is where to redirect after a form, the page it was sent from.
+// Only local paths are accepted, so it can't redirect to other sites.
+func returnTo(r *http.Request) string {
+	target := r.PostFormValue("return_to")
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, `/\`) {
+		return "/"
+	}
+	return target
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+var imageRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "image_cache_refreshes_total",
+	Help: "Image downloads by result (success, failure).",
+}, []string{"result"})
+
+var errNoImage = errors.New("image is not cached yet")
+
+// imageRetryDelay is the minimum time between downloads after a failed one.
+const imageRetryDelay = 30 * time.Second
+
+// historyDirName is the directory next to IMG_PATH with the last images.
+const historyDirName = "history"
+
+// cachedImage describes a downloaded image. It is stored as JSON next to
+// the image in the history.
+type cachedImage struct {
+	ID          string    `json:"id"`
+	SourceURL   string    `json:"source_url,omitempty"`
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag"`
+	Size        int64     `json:"size"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// imageCache keeps the random image at the cache path and replaces it once
+// it is older than the TTL. Every valid download is also kept in a history
+// of the last images, and whatever goes wrong the newest valid image keeps
+// being served. Downloads are written to a temporary file and renamed into
+// place, so readers always get a complete image, and concurrent refreshes
+// share a single download.
+type imageCache struct {
+	path       string
+	historyDir string
+	imageURL   string
+	ttl        time.Duration
+	keep       int
+	maxBytes   int64
+	client     *upstream.Client
+	group      singleflight.Group
+
+	// mu is held for writing while the file is swapped, so the metadata
+	// always matches the file readers open.
+	mu        sync.RWMutex
+	current   *cachedImage
+	history   []*cachedImage
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func newImageCache(cfg Config, client *upstream.Client) *imageCache {
+	c := &imageCache{
+		path:       cfg.ImgPath,
+		historyDir: filepath.Join(filepath.Dir(cfg.ImgPath), historyDirName),
+		imageURL:   cfg.ImgURL,
+		ttl:        cfg.ImgTTL,
+		keep:       cfg.ImgHistory,
+		maxBytes:   cfg.ImgMaxBytes,
+		client:     client,
+	}
+	if err := c.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Ignoring the cached image", "path", c.path, "error", err)
+	}
+	return c
+}
+
+// load picks up the images cached by a previous run, e.g. on the persistent
+// volume. The newest image of the history wins over the cache path, which
+// is restored from it.
+func (c *imageCache) load() error {
+	history, err := c.readHistory()
+	if err != nil {
+		slog.Warn("Failed to read image history", "dir", c.historyDir, "error", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.history = history
+	if len(history) > 0 {
+		newest := history[0]
+		if err := c.linkCurrent(newest); err != nil {
+			return err
+		}
+		c.current = newest
+		slog.Info("Using cached image", "path", c.path, "fetched_at", newest.FetchedAt, "etag", newest.ETag, "history", len(history))
+		return nil
+	}
+
+	// Images cached before there was a history.
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	cached, err := describeImage(f)
+	if err != nil {
+		return err
+	}
+	if err := c.validateImage(c.path, cached); err != nil {
+		return err
+	}
+	cached.ID = "legacy"
+	cached.FetchedAt = info.ModTime()
+	c.current = cached
+	slog.Info("Using cached image", "path", c.path, "fetched_at", cached.FetchedAt, "etag", cached.ETag)
+	return nil
+}
+
+// readHistory returns the images of the history, newest first. Entries
+// without a readable image are skipped.
+func (c *imageCache) readHistory() ([]*cachedImage, error) {
+	entries, err := os.ReadDir(c.historyDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*cachedImage
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(c.historyDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var cached cachedImage
+		if err := json.Unmarshal(data, &cached); err != nil || cached.ID != id {
+			slog.Warn("Skipping invalid image metadata", "file", entry.Name(), "error", err)
+			continue
+		}
+		info, err := os.Stat(c.historyPath(id))
+		if err != nil || info.Size() != cached.Size {
+			slog.Warn("Skipping image without a matching file", "id", id, "error", err)
+			continue
+		}
+		history = append(history, &cached)
+	}
+
+	sortNewestFirst(history)
+	return history, nil
+}
+
+func sortNewestFirst(history []*cachedImage) {
+	slices.SortFunc(history, func(a, b *cachedImage) int {
+		return b.FetchedAt.Compare(a.FetchedAt)
+	})
+}
+
+func (c *imageCache) historyPath(id string) string {
+	return filepath.Join(c.historyDir, id+".img")
+}
+
+// describeImage reads the image in r for its content type, size and ETag.
+func describeImage(r io.Reader) (*cachedImage, error) {
+	hash := sha256.New()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	hash.Write(head[:n])
+	rest, err := io.Copy(hash, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedImage{
+		ContentType: http.DetectContentType(head[:n]),
+		ETag:        `"` + hex.EncodeToString(hash.Sum(nil)[:8]) + `"`,
+		Size:        int64(n) + rest,
+	}, nil
+}
+
+// validateImage checks that the file at path, described by cached, is an
+// image and not e.g. an error page.
+func (c *imageCache) validateImage(path string, cached *cachedImage) error {
+	if cached.Size == 0 {
+		return fmt.Errorf("empty image")
+	}
+	if cached.Size > c.maxBytes {
+		return fmt.Errorf("image is larger than %d bytes", c.maxBytes)
+	}
+	if !strings.HasPrefix(cached.ContentType, "image/") {
+		return fmt.Errorf("not an image, detected %s", cached.ContentType)
+	}
+
+	// The header of formats the standard library decodes is checked beyond
+	// the magic bytes.
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, err := image.DecodeConfig(f); err != nil && !errors.Is(err, image.ErrFormat) {
+		return fmt.Errorf("invalid %s image: %w", cached.ContentType, err)
+	}
+	return nil
+}
+
+// Current returns the cached image, or nil if there is none yet.
+func (c *imageCache) Current() *cachedImage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current
+}
+
+// due reports whether a new image should be fetched: the current one is
+// older than the TTL and the last download didn't just fail.
+func (c *imageCache) due() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.lastErr != nil && time.Since(c.lastErrAt) < imageRetryDelay {
+		return false
+	}
+	return c.current == nil || time.Since(c.current.FetchedAt) > c.ttl
+}
+
+// Refresh starts a download unless one is running already and returns a
+// channel for its outcome.
+func (c *imageCache) Refresh() <-chan singleflight.Result {
+	return c.group.DoChan("image", func() (any, error) {
+		err := c.fetch(context.Background())
+
+		c.mu.Lock()
+		c.lastErr, c.lastErrAt = err, time.Now()
+		c.mu.Unlock()
+
+		if err != nil {
+			imageRefreshesTotal.WithLabelValues("failure").Inc()
+			slog.Error("Failed to refresh image, keeping the previous one", "url", c.imageURL, "etag", c.etag(), "error", err)
+			return nil, err
+		}
+		imageRefreshesTotal.WithLabelValues("success").Inc()
+		return nil, nil
+	})
+}
+
+func (c *imageCache) etag() string {
+	if current := c.Current(); current != nil {
+		return current.ETag
+	}
+	return ""
+}
+
+// Warm downloads the image unless a fresh one is cached already.
+func (c *imageCache) Warm(ctx context.Context) error {
+	if !c.due() {
+		return nil
+	}
+	select {
+	case res := <-c.Refresh():
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *imageCache) fetch(ctx context.Context) error {
+	url := fmt.Sprintf(c.imageURL, rand.Intn(1000)+1)
+	slog.Info("Fetching new image", "url", url)
+
+	resp, err := c.client.Get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
+	}
+	if header := resp.Header.Get("Content-Type"); header != "" {
+		if mediaType, _, _ := mime.ParseMediaType(header); !strings.HasPrefix(mediaType, "image/") {
+			return fmt.Errorf("not an image, got content type %q", header)
+		}
+	}
+
+	if err := os.MkdirAll(c.historyDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// The temporary file is in the same directory, as rename is only atomic
+	// within a file system.
+	tmp, err := os.CreateTemp(c.historyDir, ".image-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// One byte more than allowed is read to tell whether it was too large.
+	body := io.LimitReader(resp.Body, c.maxBytes+1)
+	cached, err := describeImage(io.TeeReader(body, tmp))
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	if err := c.validateImage(tmp.Name(), cached); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+
+	cached.FetchedAt = time.Now().UTC()
+	cached.ID = strconv.FormatInt(cached.FetchedAt.UnixNano(), 10)
+	cached.SourceURL = url
+	if err := os.Rename(tmp.Name(), c.historyPath(cached.ID)); err != nil {
+		return fmt.Errorf("failed to store image: %w", err)
+	}
+	if err := c.writeMetadata(cached); err != nil {
+		os.Remove(c.historyPath(cached.ID))
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.linkCurrent(cached); err != nil {
+		return err
+	}
+	c.current = cached
+	c.history = append([]*cachedImage{cached}, c.history...)
+	c.pruneLocked()
+
+	slog.Info("Successfully fetched and cached new image", "path", c.path, "content_type", cached.ContentType, "size", cached.Size, "etag", cached.ETag)
+	return nil
+}
+
+func (c *imageCache) writeMetadata(cached *cachedImage) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.historyDir, ".meta-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write image metadata: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write image metadata: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write image metadata: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.historyDir, cached.ID+".json")); err != nil {
+		return fmt.Errorf("failed to store image metadata: %w", err)
+	}
+	return nil
+}
+
+// linkCurrent makes the history image the one at the cache path, with a
+// hard link renamed into place.
+func (c *imageCache) linkCurrent(cached *cachedImage) error {
+	tmp := filepath.Join(c.historyDir, ".current-"+cached.ID)
+	os.Remove(tmp)
+	if err := os.Link(c.historyPath(cached.ID), tmp); err != nil {
+		return fmt.Errorf("failed to link image: %w", err)
+	}
+	// Renaming a link over another link to the same file does nothing, so
+	// tmp can still be around afterwards.
+	defer os.Remove(tmp)
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to replace image: %w", err)
+	}
+	return nil
+}
+
+// pruneLocked removes the images beyond the history size.
+func (c *imageCache) pruneLocked() {
+	if len(c.history) <= c.keep {
+		return
+	}
+	for _, old := range c.history[c.keep:] {
+		for _, path := range []string{filepath.Join(c.historyDir, old.ID+".json"), c.historyPath(old.ID)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("Failed to remove old image", "path", path, "error", err)
+			}
+		}
+	}
+	c.history = slices.Clone(c.history[:c.keep])
+}
+
+// open returns the cached file together with its metadata.
+func (c *imageCache) open() (*os.File, *cachedImage, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.current == nil {
+		return nil, nil, errNoImage
+	}
+	f, err := os.Open(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, c.current, nil
+}
+
+// Check fails until an image has been cached.
+func (c *imageCache) Check(context.Context) error {
+	if c.Current() == nil {
+		return errNoImage
+	}
+	return nil
+}
+
+// ServeHTTP serves the cached image. A stale image is still served while
+// the new one is downloaded in the background; without any the request
+// waits for the download.
+func (c *imageCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if c.due() {
+		refresh := c.Refresh()
+		if c.Current() == nil {
+			select {
+			case <-refresh:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	f, cached, err := c.open()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error opening cached image", "path", c.path, "error", err)
+		http.Error(w, "Image not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer f.Close()
+
+	maxAge := max(c.ttl-time.Since(cached.FetchedAt), 0)
+	w.Header().Set("Content-Type", cached.ContentType)
+	w.Header().Set("ETag", cached.ETag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	http.ServeContent(w, r, filepath.Base(c.path), cached.FetchedAt, f)
+}
+
+type imageHistory struct {
+	Current     *cachedImage   `json:"current"`
+	Images      []*cachedImage `json:"images"`
+	LastError   string         `json:"last_error,omitempty"`
+	LastErrorAt *time.Time     `json:"last_error_at,omitempty"`
+}
+
+// handleHistory lists the images in the history, newest first.
+func (c *imageCache) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	history := imageHistory{Current: c.current, Images: slices.Clone(c.history)}
+	if c.lastErr != nil {
+		lastErrAt := c.lastErrAt
+		history.LastError = c.lastErr.Error()
+		history.LastErrorAt = &lastErrAt
+	}
+	c.mu.RUnlock()
+
+	if history.Images == nil {
+		history.Images = []*cachedImage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding image history", "error", err)
+	}
+}
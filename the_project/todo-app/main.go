@@ -1,21 +1,36 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
-	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/health"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/metrics"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/tracing"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/upstream"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var isOldImage = false
-var alive = false
+// postsPageSize is how many todos of each list are rendered per page.
+const postsPageSize = 20
+
+// shuttingDown fails the readiness check while the server drains.
+var shuttingDown atomic.Bool
 
 type Post struct {
 	ID   int    `json:"id"`
@@ -24,113 +39,199 @@ type Post struct {
 }
 
 type TemplateData struct {
+	PageData
 	TodoPosts []Post
 	DonePosts []Post
-	PostsUrl  string
-	TodoUrl   string
+	TodoNext  string
+	DoneNext  string
+	// ReturnTo is where forms come back to.
+	ReturnTo string
+	// Degraded lists what couldn't be loaded, the page is still rendered.
+	Degraded []string
+	// LastEventID is where the live updates continue from, "" if they are
+	// unavailable. PollInterval is in milliseconds.
+	LastEventID  string
+	PollInterval int64
 }
 
-type EnvVars struct {
-	Port     string
-	PostsURL string
-	ImgPath  string
-	ImgURL   string
-	IsLocal  bool
+// TodoItem is what the todo-item partial is rendered with.
+type TodoItem struct {
+	Post      Post
+	CSRFToken string
+	ReturnTo  string
 }
 
-type MyHandler struct {
-	Vars EnvVars
+func (d TemplateData) Item(post Post) TodoItem {
+	return TodoItem{Post: post, CSRFToken: d.CSRFToken, ReturnTo: d.ReturnTo}
 }
 
-func NewHandler() *MyHandler {
-	var missing_vars []string
+// Blank is the item app.js fills in for todos pushed by live updates, with
+// ID 0 in the form actions.
+func (d TemplateData) Blank(done bool) TodoItem {
+	return d.Item(Post{Done: done})
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		missing_vars = append(missing_vars, "PORT")
-	}
+// Config is the todo-app configuration, loaded by the config package.
+type Config struct {
+	Port     string `env:"PORT" yaml:"port" required:"true" validate:"port"`
+	PostsURL string `env:"POSTS_URL" yaml:"posts_url" required:"true" validate:"url"`
+	ImgPath  string `env:"IMG_PATH" yaml:"img_path" required:"true"`
+	// ImgURL is a URL with a %d for a random image ID, e.g.
+	// https://picsum.photos/%d.
+	ImgURL string `env:"IMG_URL" yaml:"img_url" required:"true"`
+	// ImgTTL is how long an image is shown before a new one is fetched.
+	ImgTTL time.Duration `env:"IMG_TTL" yaml:"img_ttl" default:"10m"`
+	// ImgHistory is how many of the last images are kept next to IMG_PATH.
+	ImgHistory  int             `env:"IMG_HISTORY" yaml:"img_history" default:"5"`
+	ImgMaxBytes int64           `env:"IMG_MAX_BYTES" yaml:"img_max_bytes" default:"10485760"`
+	Upstream    upstream.Config `yaml:"upstream"`
+	Session     sessionConfig   `yaml:"session"`
+	Health      health.Config   `yaml:"health"`
+	Shutdown    shutdown.Config `yaml:"shutdown"`
+	Events      eventsConfig    `yaml:"events"`
+	// DevMode reads templates and static files from the working directory
+	// on every request instead of the embedded ones.
+	DevMode bool `env:"DEV_MODE" yaml:"dev_mode"`
+}
 
-	urlPosts := os.Getenv("POSTS_URL")
-	if urlPosts == "" {
-		missing_vars = append(missing_vars, "POSTS_URL")
+func (c Config) Validate() []string {
+	var problems []string
+	if c.ImgHistory < 1 {
+		problems = append(problems, "IMG_HISTORY: must be at least 1")
 	}
-
-	imgPath := os.Getenv("IMG_PATH")
-	if imgPath == "" {
-		missing_vars = append(missing_vars, "IMG_PATH")
+	if c.ImgMaxBytes < 1 {
+		problems = append(problems, "IMG_MAX_BYTES: must be at least 1")
 	}
+	problems = append(problems, c.Events.validate()...)
 
-	imgURL := os.Getenv("IMG_URL")
-	if imgURL == "" {
-		missing_vars = append(missing_vars, "IMG_URL")
+	if c.ImgURL == "" {
+		return problems
 	}
-
-	if len(missing_vars) > 0 {
-		panic(fmt.Sprintf("Environment variables %v is not set", &missing_vars))
+	if !strings.Contains(c.ImgURL, "%d") {
+		return append(problems, "IMG_URL: must contain %d for the image ID")
 	}
+	u, err := url.Parse(fmt.Sprintf(c.ImgURL, 1))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return append(problems, fmt.Sprintf("IMG_URL: invalid URL %q, expected scheme://host", c.ImgURL))
+	}
+	return problems
+}
 
-	vars := EnvVars{
-		Port:     port,
-		PostsURL: urlPosts,
-		ImgPath:  imgPath,
-		ImgURL:   imgURL,
-		IsLocal:  strings.Contains(urlPosts, "localhost"),
+type MyHandler struct {
+	Config Config
+	// Upstream propagates the trace context to todo-backend and records the
+	// outgoing requests as spans.
+	Upstream *upstream.Client
+	Images   *imageCache
+	Pages    *renderer
+	Events   *eventHub
+}
+
+func NewHandler(cfg Config) (*MyHandler, error) {
+	pages, err := newRenderer(cfg.DevMode)
+	if err != nil {
+		return nil, err
 	}
-	return &MyHandler{Vars: vars}
+
+	client := upstream.NewClient(cfg.Upstream, tracing.Client(&http.Client{}))
+	return &MyHandler{
+		Config:   cfg,
+		Upstream: client,
+		Images:   newImageCache(cfg, client),
+		Pages:    pages,
+		Events:   newEventHub(cfg.Events),
+	}, nil
 }
 
-func getPosts(urlPosts string) []Post {
-	var posts []Post
+// getPosts fetches a single page of the posts of the user token belongs to
+// and returns it together with the cursor of the next page, if there is one.
+func (h *MyHandler) getPosts(ctx context.Context, token string, params url.Values) ([]Post, string, error) {
+	urlPosts := h.Config.PostsURL
+	if len(params) > 0 {
+		urlPosts = urlPosts + "?" + params.Encode()
+	}
 
-	fmt.Printf("Fetching... %s\n", urlPosts)
+	slog.DebugContext(ctx, "Fetching posts", "url", urlPosts)
 
-	resp, err := http.Get(urlPosts)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlPosts, nil)
 	if err != nil {
-		fmt.Printf("Error making request: %v", err)
-		return posts
+		return nil, "", fmt.Errorf("error creating request: %w", err)
+	}
+	authorize(req, token)
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	resp, err := h.Upstream.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("error making request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, "", errUnauthorized
+	}
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Received non-OK status code: %d", resp.StatusCode)
-		return posts
-
+		return nil, "", fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
 	}
 
+	var posts []Post
 	err = json.NewDecoder(resp.Body).Decode(&posts)
 	if err != nil {
-		fmt.Printf("Error reading response body: %v", err)
-		return posts
+		return nil, "", fmt.Errorf("error reading response body: %w", err)
 	}
 
-	fmt.Printf("Received %d posts\n", len(posts))
+	slog.DebugContext(ctx, "Received posts", "url", urlPosts, "count", len(posts))
 
-	return posts
+	return posts, resp.Header.Get("X-Next-Cursor"), nil
 }
 
-func createImageFile(h *MyHandler) {
-	fmt.Println("Waiting 5 seconds before creating image file...")
+func postsPage(done bool, cursor string) url.Values {
+	params := url.Values{}
+	params.Set("done", strconv.FormatBool(done))
+	params.Set("limit", strconv.Itoa(postsPageSize))
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	return params
+}
+
+func createImageFile(ctx context.Context, h *MyHandler) {
+	slog.Info("Waiting 5 seconds before creating image file")
 	time.Sleep(5 * time.Second)
 
-	imgPath := h.Vars.ImgPath
-	if _, err := os.Stat(imgPath); err != nil {
-		h.fetchAndCacheImage()
-	} else {
-		fmt.Printf("Using cached image: %s\n", imgPath)
+	if err := h.Images.Warm(ctx); err != nil {
+		slog.Error("Failed to cache image", "error", err)
 	}
-	alive = true
 }
 
-func handleAlive(w http.ResponseWriter, r *http.Request) {
-	if !alive {
-		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
-		return
+func (h *MyHandler) checkBackend(ctx context.Context) error {
+	resp, err := h.Upstream.Get(ctx, h.Config.PostsURL+"?limit=1")
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "alive")
+	// Without credentials a backend with authentication answers 401, which
+	// still shows that it is up.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pageLink builds a link to the index page showing the given pages of the
+// todo and done lists.
+func pageLink(todoCursor, doneCursor string) string {
+	params := url.Values{}
+	if todoCursor != "" {
+		params.Set("todo_cursor", todoCursor)
+	}
+	if doneCursor != "" {
+		params.Set("done_cursor", doneCursor)
+	}
+	return "/?" + params.Encode()
 }
 
 func (h *MyHandler) todoHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,113 +245,112 @@ func (h *MyHandler) todoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
-	posts := getPosts(h.Vars.PostsURL)
-
-	todoPosts := []Post{}
-	donePosts := []Post{}
+	token := h.sessionToken(r)
+	query := r.URL.Query()
+	// Taken before the lists are fetched, so no change made meanwhile is
+	// missed. Replaying one that is already shown is harmless.
+	lastEventID := h.Events.position()
+	var degraded []string
+	todoPosts, todoNext, err := h.getPosts(r.Context(), token, postsPage(false, query.Get("todo_cursor")))
+	if errors.Is(err, errUnauthorized) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching todos", "error", err)
+		degraded = append(degraded, fmt.Sprintf("Todos could not be loaded: %v", err))
+	}
+	donePosts, doneNext, err := h.getPosts(r.Context(), token, postsPage(true, query.Get("done_cursor")))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error fetching done todos", "error", err)
+		degraded = append(degraded, fmt.Sprintf("Done todos could not be loaded: %v", err))
+	}
 
-	for _, post := range posts {
-		if post.Done {
-			donePosts = append(donePosts, post)
-		} else {
-			todoPosts = append(todoPosts, post)
-		}
+	if todoNext != "" {
+		todoNext = pageLink(todoNext, query.Get("done_cursor"))
+	}
+	if doneNext != "" {
+		doneNext = pageLink(query.Get("todo_cursor"), doneNext)
 	}
 
 	data := TemplateData{
+		PageData:  h.pageData(w, r),
 		TodoPosts: todoPosts,
 		DonePosts: donePosts,
-		PostsUrl:  "/posts",
-		TodoUrl:   "/todos",
-	}
-	if h.Vars.IsLocal {
-		data.PostsUrl = "http://localhost:8085/posts"
-		data.TodoUrl = fmt.Sprintf("%s/todos", strings.TrimSuffix(h.Vars.PostsURL, "posts"))
-	}
+		TodoNext:  todoNext,
+		DoneNext:  doneNext,
+		ReturnTo:  r.URL.RequestURI(),
+		Degraded:  degraded,
 
-	err := tmpl.Execute(w, data)
-
-	if err != nil {
-		log.Printf("Error executing template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		LastEventID:  lastEventID,
+		PollInterval: h.Config.Events.PollInterval.Milliseconds(),
 	}
+	h.Pages.render(w, r, http.StatusOK, "index.html", data)
 }
 
 func main() {
-	h := NewHandler()
-
-	go createImageFile(h)
-
-	http.HandleFunc("/image", h.imageHandler)
-	http.HandleFunc("/", h.todoHandler)
-	http.HandleFunc("/healthz", handleAlive)
-
-	addr := ":" + h.Vars.Port
-	fmt.Printf("Server v3 started in port %s\n", h.Vars.Port)
-
-	go fetchInBackground()
-
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
+	logging.Setup("todo-app")
 
-func fetchInBackground() {
-	ticker := time.NewTicker(10 * time.Minute)
-	defer ticker.Stop()
+	var cfg Config
+	config.MustLoad(&cfg, os.Args[1:])
 
-	for {
-		<-ticker.C
-
-		isOldImage = true
+	if err := run(cfg); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
 	}
-
 }
 
-func (h *MyHandler) imageHandler(w http.ResponseWriter, r *http.Request) {
-	if isOldImage {
-		go h.fetchAndCacheImage()
+func run(cfg Config) error {
+	h, err := NewHandler(cfg)
+	if err != nil {
+		return err
 	}
 
-	http.ServeFile(w, r, h.Vars.ImgPath)
-}
-
-func (h *MyHandler) fetchAndCacheImage() {
-	log.Println("Fetching new image...")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	id := rand.Intn(1000) + 1
-	url := fmt.Sprintf(h.Vars.ImgURL, id)
-	log.Printf("Image URL: %s", url)
-
-	resp, err := http.Get(url)
+	shutdownTracing, err := tracing.Setup(ctx, "todo-app")
 	if err != nil {
-		log.Printf("Failed to fetch image: %v", err)
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
 
-	imagePath := h.Vars.ImgPath
-	folder := filepath.Dir(imagePath)
-	err = os.MkdirAll(folder, os.ModePerm)
-	if err != nil {
-		log.Printf("Failed to create directory: %v", err)
-		return
-	}
+	go createImageFile(ctx, h)
+	go h.Events.run(ctx)
 
-	out, err := os.Create(imagePath)
-	if err != nil {
-		log.Printf("Failed to create image file: %v", err)
-		return
+	http.Handle("/static/", h.Pages.staticHandler())
+	http.Handle("/image", h.Images)
+	http.HandleFunc("/image/history", h.Images.handleHistory)
+	http.HandleFunc("/", h.todoHandler)
+	http.HandleFunc("POST /todos", h.createTodoHandler)
+	http.HandleFunc("POST /todos/{id}/{action}", h.todoActionHandler)
+	http.HandleFunc("/login", h.loginHandler)
+	http.HandleFunc("/logout", h.logoutHandler)
+	http.HandleFunc("/events", h.eventsHandler)
+	checks := []health.Check{
+		{Name: "image", Check: h.Images.Check},
+		{Name: "todo-backend", Optional: true, Check: h.checkBackend},
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		log.Printf("Failed to save image: %v", err)
+	if cfg.Events.NATSURL != "" {
+		// Without NATS the page polls, so it doesn't make the app unready.
+		checks = append(checks, health.Check{Name: "nats", Optional: true, Check: h.Events.Check})
 	}
-	log.Println("Successfully fetched and cached new image.")
-
-	isOldImage = false
+	checker := health.NewChecker(cfg.Health, &shuttingDown, checks...)
+	http.HandleFunc("/livez", checker.HandleLive)
+	http.HandleFunc("/readyz", checker.HandleReady)
+	http.HandleFunc("/healthz", checker.HandleReady)
+	http.Handle("/metrics", promhttp.Handler())
+
+	addr := ":" + h.Config.Port
+	slog.Info("Server v3 started", "port", h.Config.Port)
+
+	srv := &http.Server{Addr: addr, Handler: tracing.Handler(logging.Requests(metrics.Requests(tracing.Routes(http.DefaultServeMux))), "todo-app")}
+	srv.RegisterOnShutdown(h.Events.Close)
+	return shutdown.Serve(ctx, srv, cfg.Shutdown, func() { shuttingDown.Store(true) })
 }
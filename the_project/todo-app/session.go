@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+)
+
+// errUnauthorized is returned when todo-backend rejects the credentials of
+// the user.
+var errUnauthorized = errors.New("not signed in")
+
+// sessionConfig is the section of the service configuration for the
+// session cookie, which holds the user's todo-backend token.
+type sessionConfig struct {
+	Cookie string        `env:"SESSION_COOKIE" yaml:"cookie" default:"todo_session"`
+	MaxAge time.Duration `env:"SESSION_MAX_AGE" yaml:"max_age" default:"12h"`
+	// Secure must be set when the app is served over HTTPS.
+	Secure bool `env:"SESSION_COOKIE_SECURE" yaml:"secure"`
+}
+
+type LoginData struct {
+	PageData
+	Error string
+}
+
+// sessionToken returns the todo-backend token of the user: the bearer token
+// set by an authenticating proxy in front of the app, or the session cookie.
+func (h *MyHandler) sessionToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if scheme, token, _ := strings.Cut(header, " "); strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if cookie, err := r.Cookie(h.Config.Session.Cookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authorize forwards the user's token to todo-backend.
+func authorize(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// backendURL resolves path relative to POSTS_URL, so "me" is a sibling of
+// the posts endpoint.
+func (h *MyHandler) backendURL(path string) string {
+	base, err := url.Parse(h.Config.PostsURL)
+	if err != nil {
+		return path
+	}
+	return base.ResolveReference(&url.URL{Path: path}).String()
+}
+
+// whoAmI asks todo-backend which user token belongs to.
+func (h *MyHandler) whoAmI(ctx context.Context, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.backendURL("me"), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	authorize(req, token)
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	resp, err := h.Upstream.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
+	}
+
+	var me struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		return "", fmt.Errorf("error reading response body: %w", err)
+	}
+	return me.User, nil
+}
+
+func (h *MyHandler) setSessionCookie(w http.ResponseWriter, token string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.Config.Session.Cookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   h.Config.Session.Secure,
+		// Strict, as todo-backend accepts the cookie for writes.
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (h *MyHandler) renderLogin(w http.ResponseWriter, r *http.Request, status int, data LoginData) {
+	data.PageData = h.pageData(w, r)
+	h.Pages.render(w, r, status, "login.html", data)
+}
+
+// loginHandler asks for a todo-backend token, an API token or a JWT, and
+// keeps it in the session cookie once the backend accepted it.
+func (h *MyHandler) loginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.renderLogin(w, r, http.StatusOK, LoginData{})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !checkCSRF(w, r) {
+		return
+	}
+
+	token := strings.TrimSpace(r.PostFormValue("token"))
+	if token == "" {
+		h.renderLogin(w, r, http.StatusBadRequest, LoginData{Error: "Please enter your token."})
+		return
+	}
+
+	user, err := h.whoAmI(r.Context(), token)
+	if errors.Is(err, errUnauthorized) {
+		slog.InfoContext(r.Context(), "Login rejected by todo-backend")
+		h.renderLogin(w, r, http.StatusUnauthorized, LoginData{Error: "The token was not accepted."})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error checking token", "error", err)
+		h.renderLogin(w, r, http.StatusBadGateway, LoginData{Error: "Sign in is unavailable right now, please try again."})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User signed in", "user", user)
+	h.setSessionCookie(w, token, h.Config.Session.MaxAge)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *MyHandler) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+
+	h.setSessionCookie(w, "", -time.Second)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
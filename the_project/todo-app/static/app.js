@@ -0,0 +1,125 @@
+// Everything works without JavaScript, this only improves the page.
+document.addEventListener('submit', (event) => {
+    const form = event.target;
+    if (form.dataset.confirm && !window.confirm(form.dataset.confirm)) {
+        event.preventDefault();
+    }
+});
+
+// Live updates: changes of the user's todos are pushed from /events and
+// patched into the lists. While they are unavailable the lists are reloaded
+// every poll interval instead.
+const todos = document.getElementById('todos');
+if (todos) {
+    const pollInterval = Number(todos.dataset.pollInterval) || 30000;
+    let pollTimer = null;
+
+    // refresh fetches the page again and swaps in its lists.
+    const refresh = async () => {
+        try {
+            const response = await fetch(window.location.href, { headers: { Accept: 'text/html' } });
+            if (response.redirected && new URL(response.url).pathname === '/login') {
+                window.location.assign(response.url);
+                return;
+            }
+            if (!response.ok) {
+                return;
+            }
+            const page = new DOMParser().parseFromString(await response.text(), 'text/html');
+            const fresh = page.getElementById('todos');
+            if (fresh) {
+                todos.replaceChildren(...fresh.childNodes);
+            }
+        } catch {
+            // Offline, the next poll tries again.
+        }
+    };
+
+    const startPolling = () => {
+        pollTimer ??= setInterval(refresh, pollInterval);
+    };
+
+    const stopPolling = () => {
+        clearInterval(pollTimer);
+        pollTimer = null;
+    };
+
+    const remove = (id) => {
+        todos.querySelector(`li[data-id="${id}"]`)?.remove();
+    };
+
+    // item renders post with the template of its list.
+    const item = (post) => {
+        const template = document.getElementById(post.done ? 'done-template' : 'todo-template');
+        const li = template.content.firstElementChild.cloneNode(true);
+        li.dataset.id = post.id;
+        li.querySelector('.body').textContent = post.body;
+        for (const form of li.querySelectorAll('form')) {
+            form.setAttribute('action', form.getAttribute('action').replace('/todos/0/', `/todos/${post.id}/`));
+        }
+        return li;
+    };
+
+    // place puts post into its list, ordered by ID like todo-backend returns
+    // them. Todos that belong on another page of the list are left out.
+    const place = (post) => {
+        remove(post.id);
+        const list = document.getElementById(post.done ? 'done-list' : 'todo-list');
+        const next = [...list.children].find((li) => Number(li.dataset.id) > post.id);
+        if (next) {
+            const paged = new URLSearchParams(window.location.search).has(post.done ? 'done_cursor' : 'todo_cursor');
+            if (next !== list.firstElementChild || !paged) {
+                list.insertBefore(item(post), next);
+            }
+        } else if (!document.getElementById(post.done ? 'done-more' : 'todo-more')) {
+            list.append(item(post));
+        }
+    };
+
+    // track remembers the last event, for when the page has to connect
+    // again rather than EventSource reconnecting on its own.
+    const track = (event) => {
+        if (event.lastEventId) {
+            todos.dataset.lastEventId = event.lastEventId;
+        }
+    };
+
+    const connect = () => {
+        const url = new URL('/events', window.location.origin);
+        if (todos.dataset.lastEventId) {
+            url.searchParams.set('last_event_id', todos.dataset.lastEventId);
+        }
+
+        const source = new EventSource(url);
+        source.addEventListener('ready', stopPolling);
+        source.addEventListener('resync', (event) => {
+            track(event);
+            stopPolling();
+            refresh();
+        });
+        source.addEventListener('poll', startPolling);
+        for (const type of ['created', 'updated']) {
+            source.addEventListener(type, (event) => {
+                track(event);
+                place(JSON.parse(event.data));
+            });
+        }
+        source.addEventListener('deleted', (event) => {
+            track(event);
+            remove(JSON.parse(event.data).id);
+        });
+        source.addEventListener('error', () => {
+            startPolling();
+            // EventSource gives up on errors like 401 or 502, try again later.
+            if (source.readyState === EventSource.CLOSED) {
+                setTimeout(connect, pollInterval);
+            }
+        });
+    };
+
+    if (window.EventSource) {
+        connect();
+    } else {
+        startPolling();
+    }
+}
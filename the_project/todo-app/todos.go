@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+)
+
+// backendError is a todo-backend answer the user can act on, e.g. a
+// validation error.
+type backendError struct {
+	Status  int
+	Message string
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("todo-backend answered %d: %s", e.Status, e.Message)
+}
+
+// todoAction is a change of a single todo by a form.
+type todoAction struct {
+	Method  string
+	Payload any
+	Success string
+}
+
+var todoActions = map[string]todoAction{
+	"done":   {Method: http.MethodPatch, Payload: map[string]bool{"done": true}, Success: "Todo marked as done."},
+	"undo":   {Method: http.MethodPatch, Payload: map[string]bool{"done": false}, Success: "Todo moved back to the list."},
+	"delete": {Method: http.MethodDelete, Success: "Todo deleted."},
+}
+
+// callBackend sends a write to todo-backend on behalf of the user of r.
+func (h *MyHandler) callBackend(r *http.Request, method, url string, payload any) error {
+	var body io.Reader
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), method, url, body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	authorize(req, h.sessionToken(r))
+	forwardClient(req, r)
+	if id := logging.RequestID(r.Context()); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	resp, err := h.Upstream.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	message := strings.TrimSpace(string(msg))
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		message = strings.TrimPrefix(message, "Bad request: ")
+	case http.StatusNotFound:
+		message = "The todo doesn't exist anymore."
+	case http.StatusTooManyRequests:
+		message = "Too many changes, please wait " + resp.Header.Get("Retry-After") + " seconds."
+	default:
+		return fmt.Errorf("received non-OK status code: %d", resp.StatusCode)
+	}
+	return &backendError{Status: resp.StatusCode, Message: message}
+}
+
+// forwardClient passes the address of the browser on, so todo-backend rate
+// limits users rather than todo-app.
+func forwardClient(req *http.Request, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		host = prior + ", " + host
+	}
+	req.Header.Set("X-Forwarded-For", host)
+}
+
+// finishAction redirects back to the page the form was on with the outcome
+// as flash message (Post/Redirect/Get).
+func (h *MyHandler) finishAction(w http.ResponseWriter, r *http.Request, err error, success string) {
+	var backendErr *backendError
+	switch {
+	case err == nil:
+		setFlash(w, "success", success)
+	case errors.Is(err, errUnauthorized):
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	case errors.As(err, &backendErr):
+		slog.InfoContext(r.Context(), "Todo change rejected", "path", r.URL.Path, "status", backendErr.Status, "error", backendErr.Message)
+		setFlash(w, "error", backendErr.Message)
+	case errors.Is(err, context.Canceled):
+		return
+	default:
+		slog.ErrorContext(r.Context(), "Error changing todo", "path", r.URL.Path, "error", err)
+		setFlash(w, "error", "The change could not be saved, please try again.")
+	}
+	http.Redirect(w, r, returnTo(r), http.StatusSeeOther)
+}
+
+// createTodoHandler creates a todo from the form on the index page.
+func (h *MyHandler) createTodoHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkCSRF(w, r) {
+		return
+	}
+
+	err := h.callBackend(r, http.MethodPost, h.Config.PostsURL, map[string]string{"body": r.PostFormValue("body")})
+	h.finishAction(w, r, err, "Todo created.")
+}
+
+// todoActionHandler applies one of todoActions to the todo in the path.
+func (h *MyHandler) todoActionHandler(w http.ResponseWriter, r *http.Request) {
+	action, ok := todoActions[r.PathValue("action")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+
+	err = h.callBackend(r, action.Method, h.backendURL("todos/"+strconv.Itoa(id)), action.Payload)
+	h.finishAction(w, r, err, action.Success)
+}
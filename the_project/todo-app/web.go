@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+)
+
+//go:embed templates static
+var webFS embed.FS
+
+// PageData is what the layout and partials are rendered with, every page
+// embeds it.
+type PageData struct {
+	CSRFToken string
+	SignedIn  bool
+	Flash     *Flash
+}
+
+// pageData fills in what every page needs.
+func (h *MyHandler) pageData(w http.ResponseWriter, r *http.Request) PageData {
+	return PageData{
+		CSRFToken: h.csrfToken(w, r),
+		SignedIn:  h.sessionToken(r) != "",
+		Flash:     popFlash(w, r),
+	}
+}
+
+// renderer renders the pages in templates/pages, each within
+// templates/layout.html and with all of templates/partials.
+type renderer struct {
+	fsys fs.FS
+	// dev parses the templates on every render, so changes show up on
+	// reload without a restart.
+	dev   bool
+	pages map[string]*template.Template
+}
+
+// newRenderer parses the embedded templates, or in dev mode checks that the
+// ones in the working directory parse.
+func newRenderer(dev bool) (*renderer, error) {
+	r := &renderer{fsys: webFS, dev: dev}
+	if dev {
+		r.fsys = os.DirFS(".")
+		slog.Info("Dev mode, templates and static files are read from disk")
+	}
+
+	pages, err := parsePages(r.fsys)
+	if err != nil {
+		return nil, err
+	}
+	r.pages = pages
+	return r, nil
+}
+
+func parsePages(fsys fs.FS) (map[string]*template.Template, error) {
+	names, err := fs.Glob(fsys, "templates/pages/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		tmpl, err := template.ParseFS(fsys, "templates/layout.html", "templates/partials/*.html", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse templates: %w", err)
+		}
+		pages[path.Base(name)] = tmpl
+	}
+	return pages, nil
+}
+
+// render writes the page with the given status. The page is rendered into a
+// buffer first, so a template error results in a clean 500 instead of half
+// a page.
+func (r *renderer) render(w http.ResponseWriter, req *http.Request, status int, page string, data any) {
+	pages := r.pages
+	if r.dev {
+		var err error
+		if pages, err = parsePages(r.fsys); err != nil {
+			slog.ErrorContext(req.Context(), "Error parsing templates", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tmpl, ok := pages[page]
+	if !ok {
+		slog.ErrorContext(req.Context(), "Unknown page", "page", page)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", data); err != nil {
+		slog.ErrorContext(req.Context(), "Error executing template", "page", page, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.DebugContext(req.Context(), "Error writing page", "page", page, "error", err)
+	}
+}
+
+// staticHandler serves the files in static under /static/.
+func (r *renderer) staticHandler() http.Handler {
+	static, err := fs.Sub(r.fsys, "static")
+	if err != nil {
+		// Only fails for invalid paths.
+		panic(err)
+	}
+
+	files := http.StripPrefix("/static/", http.FileServerFS(static))
+	cacheControl := "public, max-age=3600"
+	if r.dev {
+		cacheControl = "no-cache"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		files.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// minJWTSecretLength is the shortest HS256 key accepted, shorter ones can
+// be brute forced.
+const minJWTSecretLength = 32
+
+// authConfig is the section of the service configuration for
+// authenticating API clients. Without a JWT secret and tokens the API is
+// open and everyone shares the anonymous todo list.
+type authConfig struct {
+	// JWTSecret verifies HS256 tokens, whose sub claim is the user.
+	JWTSecret   string `env:"AUTH_JWT_SECRET" yaml:"jwt_secret" secret:"true"`
+	JWTIssuer   string `env:"AUTH_JWT_ISSUER" yaml:"jwt_issuer"`
+	JWTAudience string `env:"AUTH_JWT_AUDIENCE" yaml:"jwt_audience"`
+	// Tokens are static API tokens as user:token pairs, e.g. from a Secret.
+	Tokens []string `env:"AUTH_TOKENS" yaml:"tokens" secret:"true"`
+	// Cookie is the session cookie set by todo-app, accepted when the
+	// browser calls the API directly. It is SameSite=Strict, so other sites
+	// can't send it.
+	Cookie string `env:"AUTH_COOKIE" yaml:"cookie" default:"todo_session"`
+}
+
+func (c authConfig) enabled() bool {
+	return c.JWTSecret != "" || len(c.Tokens) > 0
+}
+
+func (c authConfig) validate() []string {
+	var problems []string
+	if c.JWTSecret != "" && len(c.JWTSecret) < minJWTSecretLength {
+		problems = append(problems, fmt.Sprintf("AUTH_JWT_SECRET: must be at least %d bytes", minJWTSecretLength))
+	}
+	for i, pair := range c.Tokens {
+		user, token, ok := strings.Cut(pair, ":")
+		if !ok || user == "" || token == "" {
+			// The entry itself is a secret, so only its position is logged.
+			problems = append(problems, fmt.Sprintf("AUTH_TOKENS: entry %d must be user:token", i+1))
+		}
+	}
+	return problems
+}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// authenticator maps the credentials of a request to a user.
+type authenticator struct {
+	cfg    authConfig
+	parser *jwt.Parser
+	// tokens maps static API tokens to their user.
+	tokens map[string]string
+}
+
+func newAuthenticator(cfg authConfig) *authenticator {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.JWTIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+	if cfg.JWTAudience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.JWTAudience))
+	}
+
+	a := &authenticator{cfg: cfg, parser: jwt.NewParser(opts...), tokens: map[string]string{}}
+	for _, pair := range cfg.Tokens {
+		user, token, _ := strings.Cut(pair, ":")
+		a.tokens[token] = user
+	}
+
+	if !cfg.enabled() {
+		slog.Warn("Authentication is disabled, all clients share the anonymous todo list")
+	}
+	return a
+}
+
+// credentials returns the bearer token of r, or the session cookie.
+func (a *authenticator) credentials(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	if cookie, err := r.Cookie(a.cfg.Cookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authenticate returns the user making the request, which is empty when
+// authentication is disabled.
+func (a *authenticator) authenticate(r *http.Request) (string, error) {
+	if !a.cfg.enabled() {
+		return "", nil
+	}
+
+	token := a.credentials(r)
+	if token == "" {
+		return "", errUnauthenticated
+	}
+
+	for known, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return user, nil
+		}
+	}
+
+	if a.cfg.JWTSecret == "" {
+		return "", errUnauthenticated
+	}
+	parsed, err := a.parser.Parse(token, func(*jwt.Token) (any, error) {
+		return []byte(a.cfg.JWTSecret), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+	user, err := parsed.Claims.GetSubject()
+	if err != nil || user == "" {
+		return "", fmt.Errorf("%w: token has no subject", errUnauthenticated)
+	}
+	return user, nil
+}
+
+type userKey struct{}
+
+// userFrom returns the authenticated user of the request.
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// requireUser rejects requests without valid credentials with 401 and
+// passes the user to next in the request context.
+func (a *authenticator) requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.authenticate(r)
+		if err != nil {
+			slog.InfoContext(r.Context(), "Unauthenticated request", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="todo-backend"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if user != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", user))
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	}
+}
+
+// meHandler tells clients, e.g. the todo-app login, who their credentials
+// belong to.
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"user": userFrom(r.Context())})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticate(t *testing.T) {
+	cfg := authConfig{
+		JWTSecret:   testJWTSecret,
+		JWTIssuer:   "todo-app",
+		JWTAudience: "todo-backend",
+		Tokens:      []string{"ci:static-token", "bot:other:token"},
+		Cookie:      "todo_session",
+	}
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "alice",
+			"iss": "todo-app",
+			"aud": "todo-backend",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	valid := signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(nil))
+
+	tests := []struct {
+		name     string
+		cfg      *authConfig
+		header   string
+		cookie   string
+		wantUser string
+		wantErr  bool
+	}{
+		{name: "disabled", cfg: &authConfig{Cookie: "todo_session"}, wantUser: ""},
+		{name: "disabled ignores credentials", cfg: &authConfig{Cookie: "todo_session"}, header: "Bearer whatever", wantUser: ""},
+		{name: "no credentials", wantErr: true},
+		{name: "JWT", header: "Bearer " + valid, wantUser: "alice"},
+		{name: "JWT with lower case scheme", header: "bearer " + valid, wantUser: "alice"},
+		{name: "JWT in the session cookie", cookie: valid, wantUser: "alice"},
+		{name: "header wins over the cookie", header: "Bearer static-token", cookie: valid, wantUser: "ci"},
+		{name: "static token", header: "Bearer static-token", wantUser: "ci"},
+		{name: "static token containing a colon", header: "Bearer other:token", wantUser: "bot"},
+		{name: "unknown static token", header: "Bearer static-token2", wantErr: true},
+		{name: "basic scheme", header: "Basic static-token", wantErr: true},
+		{name: "empty bearer", header: "Bearer ", wantErr: true},
+		{name: "JWT signed with another secret", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte("another-secret-another-secret-xx"), claims(nil)), wantErr: true},
+		{name: "JWT with another algorithm", header: "Bearer " + signToken(t, jwt.SigningMethodHS512, []byte(testJWTSecret), claims(nil)), wantErr: true},
+		{name: "unsigned JWT", header: "Bearer " + signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(nil)), wantErr: true},
+		{name: "expired JWT", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), wantErr: true},
+		{name: "JWT expired within the leeway", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() })), wantUser: "alice"},
+		{name: "JWT without expiry", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { delete(c, "exp") })), wantErr: true},
+		{name: "JWT from another issuer", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { c["iss"] = "evil" })), wantErr: true},
+		{name: "JWT for another audience", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { c["aud"] = "other" })), wantErr: true},
+		{name: "JWT without subject", header: "Bearer " + signToken(t, jwt.SigningMethodHS256, []byte(testJWTSecret), claims(func(c jwt.MapClaims) { delete(c, "sub") })), wantErr: true},
+		{name: "JWT without a secret configured", cfg: &authConfig{Tokens: []string{"ci:static-token"}, Cookie: "todo_session"}, header: "Bearer " + valid, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := cfg
+			if tt.cfg != nil {
+				c = *tt.cfg
+			}
+			a := newAuthenticator(c)
+
+			r := httptest.NewRequest(http.MethodGet, "/posts", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "todo_session", Value: tt.cookie})
+			}
+
+			user, err := a.authenticate(r)
+			if tt.wantErr {
+				if !errors.Is(err, errUnauthenticated) {
+					t.Fatalf("authenticate() error = %v, want %v", err, errUnauthenticated)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate() error = %v", err)
+			}
+			if user != tt.wantUser {
+				t.Errorf("authenticate() = %q, want %q", user, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	a := newAuthenticator(authConfig{Tokens: []string{"ci:static-token"}, Cookie: "todo_session"})
+	handler := a.requireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(userFrom(r.Context())))
+	})
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "authenticated", header: "Bearer static-token", wantStatus: http.StatusOK, wantBody: "ci"},
+		{name: "unauthenticated", header: "Bearer nope", wantStatus: http.StatusUnauthorized, wantBody: "Unauthorized\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/me", nil)
+			r.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
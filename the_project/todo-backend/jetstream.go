@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	todosStream = "TODOS"
+	// todosDuplicateWindow must be longer than the outbox retry interval, so
+	// a re-published outbox row is recognised by its message ID.
+	todosDuplicateWindow = 10 * time.Minute
+	publishTimeout       = 5 * time.Second
+	tracerName           = "todo-backend"
+)
+
+var todosStreamConfig = jetstream.StreamConfig{
+	Name:       todosStream,
+	Subjects:   []string{"todo.>"},
+	Storage:    jetstream.FileStorage,
+	Retention:  jetstream.LimitsPolicy,
+	MaxAge:     7 * 24 * time.Hour,
+	Duplicates: todosDuplicateWindow,
+}
+
+func newJetStream(nc *nats.Conn) jetstream.JetStream {
+	if nc == nil {
+		return nil
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		slog.Warn("Failed to create JetStream context", "error", err)
+		return nil
+	}
+	return js
+}
+
+// ensureTodosStream declares the TODOS stream. It is retried by the outbox
+// relay until it succeeds, because NATS may not be reachable at startup.
+func (h *MyHandler) ensureTodosStream(ctx context.Context) error {
+	if h.streamReady.Load() {
+		return nil
+	}
+	if h.JS == nil {
+		return fmt.Errorf("JetStream is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	if _, err := h.JS.CreateOrUpdateStream(ctx, todosStreamConfig); err != nil {
+		return fmt.Errorf("failed to declare stream %s: %w", todosStream, err)
+	}
+
+	slog.Info("JetStream stream is ready", "stream", todosStream)
+	h.streamReady.Store(true)
+	return nil
+}
+
+// natsHeaderCarrier lets the OTel propagator read and write NATS message
+// headers.
+type natsHeaderCarrier nats.Header
+
+func (c natsHeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c natsHeaderCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// publishToNATS publishes to JetStream and waits for the ack. msgID lets the
+// server drop duplicates when an event is retried. The trace context of ctx
+// is sent along in the message headers.
+func publishToNATS(ctx context.Context, js jetstream.JetStream, subject, msgID string, msgBytes []byte) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "publish "+subject,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subject),
+			attribute.String("messaging.message.id", msgID),
+		),
+	)
+	defer span.End()
+
+	if js == nil {
+		natsPublishTotal.WithLabelValues(subject, "failure").Inc()
+		span.SetStatus(codes.Error, "NATS is not connected")
+		return fmt.Errorf("NATS is not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	msg := nats.NewMsg(subject)
+	msg.Data = msgBytes
+	otel.GetTextMapPropagator().Inject(ctx, natsHeaderCarrier(msg.Header))
+	if id := logging.RequestID(ctx); id != "" {
+		msg.Header.Set(logging.RequestIDHeader, id)
+	}
+
+	ack, err := js.PublishMsg(ctx, msg, jetstream.WithMsgID(msgID))
+	if err != nil {
+		natsPublishTotal.WithLabelValues(subject, "failure").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Error publishing to NATS", "subject", subject, "msg_id", msgID, "error", err)
+		return err
+	}
+	span.SetAttributes(attribute.Int64("messaging.nats.stream_sequence", int64(ack.Sequence)))
+
+	if ack.Duplicate {
+		natsPublishTotal.WithLabelValues(subject, "duplicate").Inc()
+		slog.InfoContext(ctx, "Duplicate ignored by stream", "subject", subject, "msg_id", msgID)
+	} else {
+		natsPublishTotal.WithLabelValues(subject, "success").Inc()
+		slog.InfoContext(ctx, "Published to NATS", "subject", subject, "msg_id", msgID, "seq", ack.Sequence)
+	}
+	return nil
+}
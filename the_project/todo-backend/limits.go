@@ -0,0 +1,177 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Buckets of clients that stayed away this long are dropped, a new bucket
+// starts full anyway.
+const limiterIdleTimeout = 10 * time.Minute
+
+// limitsConfig is the section of the service configuration that protects
+// the write endpoints.
+type limitsConfig struct {
+	// WriteRate is how many POST, PUT, PATCH and DELETE requests a client
+	// may send per second on average, WriteBurst how many in a row.
+	WriteRate  float64 `env:"RATE_LIMIT_WRITES_PER_SECOND" yaml:"write_rate" default:"1"`
+	WriteBurst int     `env:"RATE_LIMIT_BURST" yaml:"write_burst" default:"10"`
+	// TrustedProxies is how many proxies, e.g. the ingress and todo-app,
+	// forward requests. The client IP is then taken from the X-Forwarded-For
+	// entry added by the first of them instead of the connection.
+	TrustedProxies int `env:"RATE_LIMIT_TRUSTED_PROXIES" yaml:"trusted_proxies"`
+	// TrustProxy is the former setting for the ingress alone, kept so
+	// existing deployments work. It counts as one trusted proxy.
+	TrustProxy bool `env:"RATE_LIMIT_TRUST_PROXY" yaml:"trust_proxy"`
+	// MaxBodyBytes caps request bodies.
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" yaml:"max_body_bytes" default:"4096"`
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// writeLimiter keeps a token bucket per client IP.
+type writeLimiter struct {
+	cfg limitsConfig
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+func newWriteLimiter(cfg limitsConfig) *writeLimiter {
+	if cfg.TrustProxy && cfg.TrustedProxies == 0 {
+		slog.Warn("RATE_LIMIT_TRUST_PROXY is deprecated, set RATE_LIMIT_TRUSTED_PROXIES=1 instead")
+		cfg.TrustedProxies = 1
+	}
+	return &writeLimiter{
+		cfg:       cfg,
+		clients:   map[string]*clientLimiter{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *writeLimiter) limiter(ip string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > limiterIdleTimeout {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(l.cfg.WriteRate), l.cfg.WriteBurst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// clientIP is the address the request came from. X-Forwarded-For entries
+// are counted from the end, the ones before the trusted proxies are set by
+// the client and can't be relied on.
+func (l *writeLimiter) clientIP(r *http.Request) string {
+	if l.cfg.TrustedProxies > 0 {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		if i := len(hops) - l.cfg.TrustedProxies; i >= 0 {
+			if ip := strings.TrimSpace(hops[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// limitWrites caps the body size of every request and rejects writes over
+// the client's rate with 429 and a Retry-After header.
+func limitWrites(l *writeLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, l.cfg.MaxBodyBytes)
+		}
+
+		if !isWrite(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		ip := l.clientIP(r)
+		reservation := l.limiter(ip, now).ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if !reservation.OK() || delay > 0 {
+			reservation.CancelAt(now)
+			retryAfter := max(int(math.Ceil(delay.Seconds())), 1)
+			rateLimitedTotal.WithLabelValues(r.Method).Inc()
+			slog.WarnContext(r.Context(), "Rate limit exceeded", "client_ip", ip, "method", r.Method, "path", r.URL.Path, "retry_after", retryAfter)
+
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "Too many requests, retry in "+strconv.Itoa(retryAfter)+"s", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enableCORS lets the browser call the API from allowedOrigins. "*" allows
+// every origin; without any only same-origin requests work.
+func enableCORS(allowedOrigins []string, next http.Handler) http.Handler {
+	anyOrigin := slices.Contains(allowedOrigins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if origin != "" && (anyOrigin || slices.Contains(allowedOrigins, origin)) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Link, X-Next-Cursor, X-Request-ID, Retry-After")
+			// The session cookie is only sent along to origins listed by name.
+			if !anyOrigin {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		trustProxy     bool
+		remoteAddr     string
+		forwardedFor   []string
+		want           string
+	}{
+		{name: "connection", remoteAddr: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "connection without port", remoteAddr: "10.0.0.1", want: "10.0.0.1"},
+		{name: "header ignored without trusted proxies", remoteAddr: "10.0.0.1:5000", forwardedFor: []string{"1.2.3.4"}, want: "10.0.0.1"},
+		{name: "one proxy", trustedProxies: 1, remoteAddr: "10.0.0.1:5000", forwardedFor: []string{"1.2.3.4"}, want: "1.2.3.4"},
+		{name: "one proxy ignores spoofed entries", trustedProxies: 1, remoteAddr: "10.0.0.1:5000", forwardedFor: []string{"6.6.6.6, 1.2.3.4"}, want: "1.2.3.4"},
+		{name: "two proxies", trustedProxies: 2, remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"6.6.6.6, 1.2.3.4, 10.0.0.1"}, want: "1.2.3.4"},
+		{name: "entries across headers", trustedProxies: 2, remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"6.6.6.6, 1.2.3.4", "10.0.0.1"}, want: "1.2.3.4"},
+		{name: "fewer entries than proxies", trustedProxies: 2, remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"1.2.3.4"}, want: "10.0.0.2"},
+		{name: "former trust proxy setting", trustProxy: true, remoteAddr: "10.0.0.1:5000", forwardedFor: []string{"6.6.6.6, 1.2.3.4"}, want: "1.2.3.4"},
+		{name: "trusted proxies win over the former setting", trustedProxies: 2, trustProxy: true, remoteAddr: "10.0.0.2:5000", forwardedFor: []string{"6.6.6.6, 1.2.3.4, 10.0.0.1"}, want: "1.2.3.4"},
+		{name: "empty entry", trustedProxies: 1, remoteAddr: "10.0.0.1:5000", forwardedFor: []string{"1.2.3.4, "}, want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newWriteLimiter(limitsConfig{WriteRate: 1, WriteBurst: 1, TrustedProxies: tt.trustedProxies, TrustProxy: tt.trustProxy, MaxBodyBytes: 10})
+			r := httptest.NewRequest(http.MethodPost, "/posts", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := l.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitWrites(t *testing.T) {
+	type request struct {
+		method     string
+		remoteAddr string
+		body       string
+		wantStatus int
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{
+			name: "writes over the burst are rejected",
+			requests: []request{
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodPut, remoteAddr: "10.0.0.1:5001", wantStatus: http.StatusOK},
+				{method: http.MethodDelete, remoteAddr: "10.0.0.1:5002", wantStatus: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "reads are not limited",
+			requests: []request{
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodGet, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodHead, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+			},
+		},
+		{
+			name: "clients have their own buckets",
+			requests: []request{
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusOK},
+				{method: http.MethodPost, remoteAddr: "10.0.0.2:5000", wantStatus: http.StatusOK},
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", wantStatus: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "body over the limit",
+			requests: []request{
+				{method: http.MethodPost, remoteAddr: "10.0.0.1:5000", body: "0123456789", wantStatus: http.StatusOK},
+				{method: http.MethodPost, remoteAddr: "10.0.0.2:5000", body: "0123456789x", wantStatus: http.StatusRequestEntityTooLarge},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Too slow a refill for a token to come back during the test.
+			l := newWriteLimiter(limitsConfig{WriteRate: 0.001, WriteBurst: 2, MaxBodyBytes: 10})
+			handler := limitWrites(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := io.ReadAll(r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				}
+			}))
+
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(req.method, "/posts", strings.NewReader(req.body))
+				r.RemoteAddr = req.remoteAddr
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				if w.Code != req.wantStatus {
+					t.Fatalf("request %d: status = %d, want %d", i, w.Code, req.wantStatus)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: no Retry-After header", i)
+				}
+			}
+		})
+	}
+}
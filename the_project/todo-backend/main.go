@@ -1,94 +1,170 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"html"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/XSAM/otelsql"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/database"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/health"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/metrics"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/tracing"
 	_ "github.com/lib/pq"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Post struct {
 	ID   int    `json:"id"`
 	Body string `json:"body"`
 	Done bool   `json:"done"`
+	// Owner is the user the todo belongs to, empty for the anonymous list.
+	Owner string `json:"owner,omitempty"`
 }
 
-type MyHandler struct {
-	Db   *sql.DB
-	Nats *nats.Conn
-	dbMu sync.RWMutex
+// Config is the todo-backend configuration, loaded by the config
+// package.
+type Config struct {
+	Port    string `env:"PORT" yaml:"port" required:"true" validate:"port"`
+	NATSURL string `env:"NATS_URL" yaml:"nats_url" required:"true" validate:"url"`
+	// CORSAllowedOrigins are the origins of web apps that may call the API
+	// from the browser, by default todo-app on http://localhost:8089. "*"
+	// allows any.
+	CORSAllowedOrigins []string        `env:"CORS_ALLOWED_ORIGINS" yaml:"cors_allowed_origins" default:"http://localhost:8089"`
+	Limits             limitsConfig    `yaml:"limits"`
+	Auth               authConfig      `yaml:"auth"`
+	DB                 database.Config `yaml:"db"`
+	Health             health.Config   `yaml:"health"`
+	Shutdown           shutdown.Config `yaml:"shutdown"`
 }
 
-func connectToNATS() *nats.Conn {
-	natsURL := os.Getenv("NATS_URL")
-	if natsURL == "" {
-		panic("Environmental variable NATS_URL is not set")
+func (c Config) Validate() []string {
+	var problems []string
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: invalid origin %q, expected scheme://host[:port] or *", origin))
+		}
 	}
-
-	log.Printf("Connecting to NATS at %s...", natsURL)
-	nc, err := nats.Connect(natsURL)
-	if err != nil {
-		log.Printf("WARNING: Failed to connect to NATS: %v. The app will work, but messages won't be sent.", err)
-		return nil
+	if c.Limits.WriteRate <= 0 {
+		problems = append(problems, "RATE_LIMIT_WRITES_PER_SECOND: must be greater than 0")
+	}
+	if c.Limits.WriteBurst < 1 {
+		problems = append(problems, "RATE_LIMIT_BURST: must be at least 1")
 	}
+	if c.Limits.TrustedProxies < 0 {
+		problems = append(problems, "RATE_LIMIT_TRUSTED_PROXIES: must not be negative")
+	}
+	if c.Limits.MaxBodyBytes < 1 {
+		problems = append(problems, "MAX_BODY_BYTES: must be at least 1")
+	}
+	return append(problems, c.Auth.validate()...)
+}
 
-	log.Println("Successfully connected to NATS.")
-	return nc
+type MyHandler struct {
+	DB           *database.Manager
+	Nats         *nats.Conn
+	JS           jetstream.JetStream
+	streamReady  atomic.Bool
+	shuttingDown atomic.Bool
 }
 
-func publishToNATS(nc *nats.Conn, subject string, payload any) {
-	msgBytes, err := json.Marshal(payload)
+func connectToNATS(natsURL string) *nats.Conn {
+	slog.Info("Connecting to NATS", "url", natsURL)
+	nc, err := nats.Connect(natsURL,
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}),
+	)
 	if err != nil {
-		log.Printf("Error marshalling NATS payload for subject %s: %v", subject, err)
-		return
+		slog.Warn("Failed to connect to NATS, events will stay in the outbox", "error", err)
+		return nil
 	}
 
-	if err := nc.Publish(subject, msgBytes); err != nil {
-		log.Printf("Error publishing to NATS subject %s: %v", subject, err)
+	if nc.IsConnected() {
+		slog.Info("Successfully connected to NATS")
 	} else {
-		log.Printf("NATS: Published to '%s': %s", subject, string(msgBytes))
+		slog.Warn("NATS is not reachable yet, retrying in the background. Events stay in the outbox meanwhile")
 	}
+	return nc
 }
 
-func getPosts(db *sql.DB) ([]Post, error) {
-	rows, err := db.Query("SELECT id, body, done FROM posts ORDER BY id ASC")
+// getPosts returns one page of posts matching q and the cursor of the next
+// page, which is empty on the last page.
+func getPosts(ctx context.Context, db *sql.DB, q postQuery) ([]Post, string, error) {
+	defer observeQuery("list_posts", time.Now())
+
+	query, args := q.sql()
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("error querying posts: %w", err)
+		return nil, "", fmt.Errorf("error querying posts: %w", err)
 	}
 	defer rows.Close()
 
-	var posts []Post
+	posts := []Post{}
 	for rows.Next() {
 		var post Post
-		if err := rows.Scan(&post.ID, &post.Body, &post.Done); err != nil {
-			return nil, fmt.Errorf("error scanning post row: %w", err)
+		if err := rows.Scan(&post.ID, &post.Body, &post.Done, &post.Owner); err != nil {
+			return nil, "", fmt.Errorf("error scanning post row: %w", err)
 		}
 		posts = append(posts, post)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over post rows: %w", err)
+		return nil, "", fmt.Errorf("error iterating over post rows: %w", err)
 	}
 
-	return posts, nil
+	var next string
+	if len(posts) > q.Limit {
+		posts = posts[:q.Limit]
+		next = q.cursorFor(posts[len(posts)-1])
+	}
+
+	return posts, next, nil
 }
 
 func (h *MyHandler) getDB() *sql.DB {
-	h.dbMu.RLock()
-	defer h.dbMu.RUnlock()
-	return h.Db
+	return h.DB.DB()
 }
 
-func (h *MyHandler) postsGet(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func (h *MyHandler) postsGet(w http.ResponseWriter, r *http.Request) {
+	q, err := parsePostQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Owner = userFrom(r.Context())
 
 	db := h.getDB()
 
@@ -97,42 +173,79 @@ func (h *MyHandler) postsGet(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
-	posts, err := getPosts(db)
+	posts, next, err := getPosts(r.Context(), db, q)
 	if err != nil {
-		log.Printf("Error retrieving posts: %v", err)
+		slog.ErrorContext(r.Context(), "Error retrieving posts", "error", err)
 		http.Error(w, "Failed to retrieve posts", http.StatusInternalServerError)
 		return
 	}
 
-	jsonPosts, err := json.Marshal(posts)
-	if err != nil {
-		log.Printf("Error marshalling posts to JSON: %v", err)
-		http.Error(w, "Failed to serialize posts", http.StatusInternalServerError)
-		return
+	if next != "" {
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", next)
+		w.Header().Set("X-Next-Cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, nextQuery.Encode()))
 	}
 
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(jsonPosts); err != nil {
-		log.Printf("Error writing response: %v", err)
+	writeJSON(w, http.StatusOK, posts)
+}
+
+type postRequest struct {
+	Body string `json:"body"`
+}
+
+func isJSONContent(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// wantsJSON reports whether the client prefers a JSON response. JSON requests
+// get JSON back unless the Accept header explicitly asks for HTML first.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
 	}
+	return isJSONContent(r)
 }
 
-func (h *MyHandler) postsPost(w http.ResponseWriter, r *http.Request) {
+func readPostBody(r *http.Request) (string, error) {
+	if isJSONContent(r) {
+		var req postRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return "", fmt.Errorf("failed to parse JSON body: %w", err)
+		}
+		return req.Body, nil
+	}
+
 	if err := r.ParseForm(); err != nil {
-		log.Printf("Error parsing form: %v", err)
-		http.Error(w, "Bad request: failed to parse form", http.StatusBadRequest)
-		return
+		return "", fmt.Errorf("failed to parse form: %w", err)
 	}
+	return r.FormValue("body"), nil
+}
 
-	body := r.FormValue("body")
-	if body == "" {
-		http.Error(w, "Bad request: 'body' cannot be empty", http.StatusBadRequest)
+func (h *MyHandler) postsPost(w http.ResponseWriter, r *http.Request) {
+	body, err := readPostBody(r)
+	if tooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if len(body) > 140 {
-		log.Printf("Todo is too long: %d characters", len(body))
-		http.Error(w, "Bad request: 'body' cannot be longer than 140 characters", http.StatusBadRequest)
+	if err := validatePostBody(body); err != nil {
+		slog.WarnContext(r.Context(), "Invalid todo", "error", err)
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -143,48 +256,142 @@ func (h *MyHandler) postsPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Adding a new todo: %s", body)
-
-	var newID int
-	err := db.QueryRow("INSERT INTO posts (body) VALUES ($1) RETURNING id", body).Scan(&newID)
+	var newPost Post
+	err = withTx(r.Context(), db, func(tx *sql.Tx) error {
+		defer observeQuery("insert_post", time.Now())
+		err := tx.QueryRowContext(r.Context(), "INSERT INTO posts (body, owner) VALUES ($1, $2) RETURNING id, body, done, owner", body, userFrom(r.Context())).Scan(&newPost.ID, &newPost.Body, &newPost.Done, &newPost.Owner)
+		if err != nil {
+			return err
+		}
+		return enqueueEvent(r.Context(), tx, "todo.created", newPost)
+	})
 	if err != nil {
-		log.Printf("Error inserting post into database: %v", err)
+		slog.ErrorContext(r.Context(), "Error inserting post into database", "error", err)
 		http.Error(w, "Failed to create post", http.StatusInternalServerError)
 		return
 	}
+	slog.InfoContext(r.Context(), "Todo created", "todo_id", newPost.ID, "body", newPost.Body, "owner", newPost.Owner)
+
+	w.Header().Set("Location", fmt.Sprintf("/todos/%d", newPost.ID))
 
-	newPost := Post{ID: newID, Body: body, Done: false}
-	publishToNATS(h.Nats, "todo.created", newPost)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, newPost)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "Post %s was added successfully", body)
+	fmt.Fprintf(w, "Post %s was added successfully", html.EscapeString(body))
+}
+
+func (h *MyHandler) checkNATS(_ context.Context) error {
+	if h.Nats == nil {
+		return fmt.Errorf("NATS not configured")
+	}
+	if status := h.Nats.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("NATS connection is %s", status)
+	}
+	return nil
+}
+
+type postPatch struct {
+	Body *string `json:"body"`
+	Done *bool   `json:"done"`
+}
+
+// tooLarge answers 413 if err is from a body over the MAX_BODY_BYTES cap.
+func tooLarge(w http.ResponseWriter, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Request body too large, the limit is %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+func validatePostBody(body string) error {
+	if body == "" {
+		return fmt.Errorf("'body' cannot be empty")
+	}
+
+	if len(body) > 140 {
+		return fmt.Errorf("'body' cannot be longer than 140 characters")
+	}
+
+	return nil
 }
 
-func (h *MyHandler) handleAlive(w http.ResponseWriter, r *http.Request) {
-	if h.Db == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, "database not connected\n")
+// getPost returns the post with the given id if it belongs to owner.
+func getPost(ctx context.Context, db *sql.DB, owner string, id int) (Post, error) {
+	defer observeQuery("get_post", time.Now())
+
+	var post Post
+	err := db.QueryRowContext(ctx, "SELECT id, body, done, owner FROM posts WHERE id = $1 AND owner = $2", id, owner).Scan(&post.ID, &post.Body, &post.Done, &post.Owner)
+	if err != nil {
+		return post, err
+	}
+	return post, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error marshalling response to JSON", "error", err)
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "alive")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(jsonPayload); err != nil {
+		slog.Error("Error writing response", "error", err)
+	}
 }
 
-func (h *MyHandler) markDoneHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func (h *MyHandler) todoGet(w http.ResponseWriter, r *http.Request, id int) {
+	db := h.getDB()
+
+	if db == nil {
+		http.Error(w, "Database not ready", http.StatusServiceUnavailable)
 		return
 	}
 
-	idString := r.PathValue("id")
-	id, err := strconv.Atoi(idString)
+	post, err := getPost(r.Context(), db, userFrom(r.Context()), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Error retrieving post", "todo_id", id, "error", err)
+		http.Error(w, "Failed to retrieve post", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, post)
+}
+
+func (h *MyHandler) todoPatch(w http.ResponseWriter, r *http.Request, id int) {
+	var patch postPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		if tooLarge(w, err) {
+			return
+		}
+		http.Error(w, "Bad request: invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if patch.Body == nil && patch.Done == nil {
+		http.Error(w, "Bad request: nothing to update, expected 'body' and/or 'done'", http.StatusBadRequest)
 		return
 	}
 
+	if patch.Body != nil {
+		if err := validatePostBody(*patch.Body); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	db := h.getDB()
 
 	if db == nil {
@@ -192,32 +399,117 @@ func (h *MyHandler) markDoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec("UPDATE posts SET done = TRUE WHERE id = $1", id)
+	var post Post
+	err := withTx(r.Context(), db, func(tx *sql.Tx) error {
+		defer observeQuery("update_post", time.Now())
+		err := tx.QueryRowContext(r.Context(),
+			"UPDATE posts SET body = COALESCE($3, body), done = COALESCE($4, done) WHERE id = $1 AND owner = $2 RETURNING id, body, done, owner",
+			id, userFrom(r.Context()), patch.Body, patch.Done,
+		).Scan(&post.ID, &post.Body, &post.Done, &post.Owner)
+		if err != nil {
+			return err
+		}
+		return enqueueEvent(r.Context(), tx, "todo.updated", post)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Error updating post in database: %v", err)
+		slog.ErrorContext(r.Context(), "Error updating post in database", "todo_id", id, "error", err)
 		http.Error(w, "Failed to update post", http.StatusInternalServerError)
 		return
 	}
+	slog.InfoContext(r.Context(), "Todo updated", "todo_id", post.ID, "done", post.Done)
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+	writeJSON(w, http.StatusOK, post)
+}
+
+func (h *MyHandler) todoDelete(w http.ResponseWriter, r *http.Request, id int) {
+	db := h.getDB()
+
+	if db == nil {
+		http.Error(w, "Database not ready", http.StatusServiceUnavailable)
 		return
 	}
 
-	if rowsAffected == 0 {
+	var post Post
+	err := withTx(r.Context(), db, func(tx *sql.Tx) error {
+		defer observeQuery("delete_post", time.Now())
+		err := tx.QueryRowContext(r.Context(), "DELETE FROM posts WHERE id = $1 AND owner = $2 RETURNING id, body, done, owner", id, userFrom(r.Context())).Scan(&post.ID, &post.Body, &post.Done, &post.Owner)
+		if err != nil {
+			return err
+		}
+		return enqueueEvent(r.Context(), tx, "todo.deleted", post)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting post from database", "todo_id", id, "error", err)
+		http.Error(w, "Failed to delete post", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Todo deleted", "todo_id", id)
 
-	updatedPost := Post{ID: id, Done: true}
-	publishToNATS(h.Nats, "todo.updated", updatedPost)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *MyHandler) markDoneHandler(w http.ResponseWriter, r *http.Request, id int) {
+	db := h.getDB()
+
+	if db == nil {
+		http.Error(w, "Database not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := withTx(r.Context(), db, func(tx *sql.Tx) error {
+		defer observeQuery("mark_done", time.Now())
+		var updatedPost Post
+		err := tx.QueryRowContext(r.Context(), "UPDATE posts SET done = TRUE WHERE id = $1 AND owner = $2 RETURNING id, body, done, owner", id, userFrom(r.Context())).Scan(&updatedPost.ID, &updatedPost.Body, &updatedPost.Done, &updatedPost.Owner)
+		if err != nil {
+			return err
+		}
+		return enqueueEvent(r.Context(), tx, "todo.updated", updatedPost)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error updating post in database", "todo_id", id, "error", err)
+		http.Error(w, "Failed to update post", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Todo marked as done", "todo_id", id)
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Post with ID %d marked as done", id)
 }
 
+func (h *MyHandler) todoHandler(w http.ResponseWriter, r *http.Request) {
+	idString := r.PathValue("id")
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.todoGet(w, r, id)
+	case http.MethodPut:
+		h.markDoneHandler(w, r, id)
+	case http.MethodPatch:
+		h.todoPatch(w, r, id)
+	case http.MethodDelete:
+		h.todoDelete(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (h *MyHandler) handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		h.postsGet(w, r)
@@ -232,133 +524,171 @@ func (h *MyHandler) handler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+func main() {
+	logging.Setup("todo-backend")
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		// The migration Job shares the config of the service.
+		var cfg Config
+		args := config.MustLoad(&cfg, os.Args[2:])
+		if err := migrator.RunCommand(cfg.DB, args); err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	var cfg Config
+	config.MustLoad(&cfg, os.Args[1:])
+
+	if err := run(cfg); err != nil {
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		panic("Environmental variable PORT is not set")
+func run(cfg Config) error {
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// ctx is also cancelled if the database can't be reached in time.
+	ctx, fail := context.WithCancelCause(sigCtx)
+	defer fail(nil)
+
+	shutdownTracing, err := tracing.Setup(ctx, "todo-backend")
+	if err != nil {
+		return err
 	}
+	defer func() {
+		// Flush the remaining spans after everything else has stopped.
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
 
-	nc := connectToNATS()
+	dbm := database.NewManager(cfg.DB, initDatabase)
+	if dbm.Driver, err = tracedPostgresDriver(); err != nil {
+		return err
+	}
+
+	nc := connectToNATS(cfg.NATSURL)
 	if nc != nil {
 		defer nc.Close()
 	}
 
 	h := &MyHandler{
-		Db:   nil,
+		DB:   dbm,
 		Nats: nc,
+		JS:   newJetStream(nc),
 	}
 
 	go func() {
-		log.Println("Waiting 5 seconds to connect to database...")
-		time.Sleep(5 * time.Second)
-
-		db, err := connectToDB()
-		if err != nil {
-			log.Fatalf("Failed to connect to DB: %v", err)
-		}
+		connectCtx, cancel := context.WithTimeout(ctx, cfg.DB.ConnectTimeout)
+		defer cancel()
 
-		err = initDatabase(db)
-		if err != nil {
-			log.Fatalf("Failed to initialize database: %v", err)
+		if err := h.DB.Connect(connectCtx); err != nil {
+			fail(err)
+			return
 		}
-
-		h.dbMu.Lock()
-		h.Db = db
-		h.dbMu.Unlock()
-		log.Println("Database connected and initialized.")
+		h.DB.Watch(ctx)
 	}()
+	defer h.DB.Close()
 
+	// The relay is stopped before the database is closed.
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		h.runOutboxRelay(relayCtx)
+		close(relayDone)
+	}()
 	defer func() {
-		dbToClose := h.getDB()
-
-		if dbToClose != nil {
-			if err := dbToClose.Close(); err != nil {
-				log.Printf("Error closing database connection: %v", err)
-			}
-		}
+		stopRelay()
+		<-relayDone
 	}()
 
-	addr := ":" + port
+	addr := ":" + cfg.Port
 
-	fmt.Printf("Server v2 started in port %s\n", port)
+	slog.Info("Server v2 started", "port", cfg.Port)
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/posts", h.handler)
-	mux.HandleFunc("/healthz", h.handleAlive)
+	auth := newAuthenticator(cfg.Auth)
+	mux.HandleFunc("/posts", auth.requireUser(h.handler))
+	mux.HandleFunc("/me", auth.requireUser(meHandler))
+	// NATS is optional for readiness: events wait in the outbox meanwhile.
+	checker := health.NewChecker(cfg.Health, &h.shuttingDown,
+		health.Check{Name: "database", Check: h.DB.Check},
+		health.Check{Name: "nats", Optional: true, Check: h.checkNATS},
+	)
+	mux.HandleFunc("/livez", checker.HandleLive)
+	mux.HandleFunc("/readyz", checker.HandleReady)
+	mux.HandleFunc("/healthz", checker.HandleReady)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/posts", http.StatusMovedPermanently)
 	})
-	mux.HandleFunc("/todos/{id}", h.markDoneHandler)
+	// Other users' todos are answered with 404, as if they didn't exist.
+	mux.HandleFunc("/todos/{id}", auth.requireUser(h.todoHandler))
 
-	log.Fatal(http.ListenAndServe(addr, enableCORS(mux)))
-}
+	prometheus.MustRegister(todoCollector{h: h})
+	prometheus.MustRegister(outboxCollector{h: h})
+	mux.Handle("/metrics", promhttp.Handler())
 
-func connectToDB() (*sql.DB, error) {
-	connStr := os.Getenv("DB_URL")
-	if connStr == "" {
-		return nil, fmt.Errorf("DB_URL environment variable is not set")
+	srv := &http.Server{Addr: addr, Handler: tracing.Handler(logging.Requests(metrics.Requests(enableCORS(cfg.CORSAllowedOrigins, limitWrites(newWriteLimiter(cfg.Limits), tracing.Routes(mux))))), "todo-backend")}
+	if err := shutdown.Serve(ctx, srv, cfg.Shutdown, func() { h.shuttingDown.Store(true) }); err != nil {
+		return err
 	}
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database connection: %w", err)
+
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		return cause
 	}
-	err = db.Ping()
+	return nil
+}
+
+// tracedPostgresDriver wraps lib/pq so queries show up as spans. Queries
+// outside a trace, e.g. the outbox polling, are skipped to keep the noise down.
+func tracedPostgresDriver() (string, error) {
+	name, err := otelsql.Register("postgres",
+		otelsql.WithAttributes(attribute.String("db.system.name", "postgresql")),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+		return "", fmt.Errorf("failed to register traced postgres driver: %w", err)
 	}
-	log.Println("Successfully connected to the database.")
-	return db, nil
+	return name, nil
 }
 
-func initDatabase(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS posts (
-			id SERIAL PRIMARY KEY,
-			body TEXT NOT NULL,
-			done BOOLEAN DEFAULT FALSE
-		);
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create posts table: %w", err)
+func initDatabase(ctx context.Context, db *sql.DB) error {
+	if err := migrator.Up(ctx, db); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	_, err = db.Exec(`ALTER TABLE posts ADD COLUMN IF NOT EXISTS done BOOLEAN DEFAULT FALSE;`)
-	if err != nil {
-		return fmt.Errorf("failed to add done column: %w", err)
+	var hasPosts bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM posts)").Scan(&hasPosts); err != nil {
+		return fmt.Errorf("failed to check for existing posts: %w", err)
 	}
 
-	posts, _ := getPosts(db)
-	if len(posts) == 0 {
+	if !hasPosts {
 		var posts = []string{
 			"Learn JavaScript",
 			"Learn React",
 			"Build a project",
 		}
 		for _, post := range posts {
-			_, err := db.Exec("INSERT INTO posts (body) VALUES ($1)", post)
+			_, err := db.ExecContext(ctx, "INSERT INTO posts (body) VALUES ($1)", post)
 			if err != nil {
-				log.Printf("Error inserting post into database: %v", err)
-				panic(err)
+				return fmt.Errorf("failed to insert initial post: %w", err)
 			}
 		}
 	}
 
-	log.Println("Posts table initialized successfully.")
+	slog.Info("Posts table initialized successfully")
 	return nil
 }
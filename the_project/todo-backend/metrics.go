@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Database query latency by query.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query"})
+
+	natsPublishTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_publish_total",
+		Help: "JetStream publishes by subject and result (success, duplicate, failure).",
+	}, []string{"subject", "result"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_rate_limited_total",
+		Help: "Write requests rejected with 429 by method.",
+	}, []string{"method"})
+
+	todosDesc = prometheus.NewDesc(
+		"todos",
+		"Number of todos by done state.",
+		[]string{"done"}, nil,
+	)
+
+	outboxPendingDesc = prometheus.NewDesc(
+		"outbox_pending_events",
+		"Outbox events waiting to be published.",
+		nil, nil,
+	)
+
+	outboxOldestPendingDesc = prometheus.NewDesc(
+		"outbox_oldest_pending_age_seconds",
+		"Age of the oldest outbox event waiting to be published, 0 if there is none.",
+		nil, nil,
+	)
+
+	outboxFailedDesc = prometheus.NewDesc(
+		"outbox_failed_events",
+		"Outbox events given up on after too many attempts.",
+		nil, nil,
+	)
+)
+
+// observeQuery records the time since start under the given query name.
+func observeQuery(query string, start time.Time) {
+	dbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// countTimeout bounds the count query of a scrape.
+const countTimeout = 2 * time.Second
+
+// todoCollector counts the todos on every scrape, so the numbers are right
+// across replicas and restarts.
+type todoCollector struct {
+	h *MyHandler
+}
+
+func (c todoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- todosDesc
+}
+
+func (c todoCollector) Collect(ch chan<- prometheus.Metric) {
+	db := c.h.getDB()
+	if db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+
+	defer observeQuery("count_todos", time.Now())
+
+	counts := map[bool]float64{false: 0, true: 0}
+	rows, err := db.QueryContext(ctx, "SELECT done, COUNT(*) FROM posts GROUP BY done")
+	if err != nil {
+		slog.Error("Error counting todos for metrics", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var done bool
+		var count float64
+		if err := rows.Scan(&done, &count); err != nil {
+			slog.Error("Error scanning todo count", "error", err)
+			return
+		}
+		counts[done] = count
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Error counting todos for metrics", "error", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(todosDesc, prometheus.GaugeValue, counts[false], "false")
+	ch <- prometheus.MustNewConstMetric(todosDesc, prometheus.GaugeValue, counts[true], "true")
+}
+
+// outboxCollector reports the outbox backlog on every scrape, so a stalled
+// relay can be alerted on.
+type outboxCollector struct {
+	h *MyHandler
+}
+
+func (c outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- outboxPendingDesc
+	ch <- outboxOldestPendingDesc
+	ch <- outboxFailedDesc
+}
+
+func (c outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	db := c.h.getDB()
+	if db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+
+	defer observeQuery("count_outbox", time.Now())
+
+	var pending, oldest, failed float64
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE failed_at IS NULL),
+			COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at) FILTER (WHERE failed_at IS NULL)), 0),
+			COUNT(*) FILTER (WHERE failed_at IS NOT NULL)
+		FROM outbox
+		WHERE sent_at IS NULL
+	`).Scan(&pending, &oldest, &failed)
+	if err != nil {
+		slog.Error("Error counting outbox events for metrics", "error", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(outboxPendingDesc, prometheus.GaugeValue, pending)
+	ch <- prometheus.MustNewConstMetric(outboxOldestPendingDesc, prometheus.GaugeValue, oldest)
+	ch <- prometheus.MustNewConstMetric(outboxFailedDesc, prometheus.GaugeValue, failed)
+}
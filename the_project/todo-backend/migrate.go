@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/database"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrator applies the schema of todo-backend. Its lock ID must differ from
+// those of the other services sharing the database.
+var migrator = &database.Migrator{
+	Service: "todo-backend",
+	LockID:  7346011,
+	FS:      migrationsFS,
+	Dir:     "migrations",
+}
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS posts (
+    id SERIAL PRIMARY KEY,
+    body TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS posts_owner_id_idx ON posts (owner, id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS outbox_unsent_idx;
+ALTER TABLE outbox DROP COLUMN IF EXISTS locked_until;
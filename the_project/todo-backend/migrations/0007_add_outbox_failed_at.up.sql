@@ -0,0 +1,3 @@
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+DROP INDEX IF EXISTS outbox_unsent_idx;
+CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL AND failed_at IS NULL;
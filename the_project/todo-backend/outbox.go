@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second
+	outboxBatchSize    = 100
+	// outboxClaimTimeout is how long a relay owns the events it claimed.
+	// Publishing a batch gives up before, so no other replica sends them too.
+	outboxClaimTimeout = time.Minute
+	// outboxMaxAttempts is how often an event is published before it is
+	// marked failed and skipped, so it doesn't hold up the events behind it.
+	outboxMaxAttempts = 10
+	// outboxRetention is how long sent events are kept before being purged.
+	outboxRetention = 24 * time.Hour
+)
+
+type outboxEvent struct {
+	ID      int64
+	Subject string
+	Payload []byte
+	// Headers carry the trace context of the request that created the event.
+	Headers []byte
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// enqueueEvent stores an event in the outbox as part of tx. The relay
+// publishes it to NATS once the transaction has committed, continuing the
+// trace found in ctx.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, subject string, payload any) error {
+	msgBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshalling payload for subject %s: %w", subject, err)
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if id := logging.RequestID(ctx); id != "" {
+		carrier.Set(logging.RequestIDHeader, id)
+	}
+	headers, err := json.Marshal(carrier)
+	if err != nil {
+		return fmt.Errorf("error marshalling headers for subject %s: %w", subject, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO outbox (subject, payload, headers) VALUES ($1, $2, $3)", subject, msgBytes, headers)
+	if err != nil {
+		return fmt.Errorf("error inserting %s into outbox: %w", subject, err)
+	}
+	return nil
+}
+
+// runOutboxRelay publishes pending outbox rows until ctx is cancelled.
+// Replicas claim rows before publishing them, so each is sent by one relay.
+func (h *MyHandler) runOutboxRelay(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	lastPurge := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		db := h.getDB()
+		if db == nil {
+			continue
+		}
+
+		if err := h.ensureTodosStream(ctx); err != nil {
+			slog.Warn("Outbox relay waiting for NATS", "error", err)
+			continue
+		}
+
+		for {
+			sent, err := h.relayOutboxBatch(ctx, db)
+			if err != nil {
+				slog.Error("Error relaying outbox", "error", err)
+				break
+			}
+			if sent < outboxBatchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			if _, err := db.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at < $1", time.Now().Add(-outboxRetention)); err != nil {
+				slog.Error("Error purging sent outbox events", "error", err)
+			}
+			lastPurge = time.Now()
+		}
+	}
+}
+
+// relayOutboxBatch publishes the oldest pending events in order. They are
+// claimed in a short transaction and published outside of it, the first
+// failure ends the batch so later events don't overtake it.
+func (h *MyHandler) relayOutboxBatch(ctx context.Context, db *sql.DB) (int, error) {
+	events, err := claimOutboxBatch(ctx, db)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, outboxClaimTimeout)
+	defer cancel()
+
+	for i, event := range events {
+		msgID := fmt.Sprintf("outbox-%d", event.ID)
+		if err := publishToNATS(event.traceContext(publishCtx), h.JS, event.Subject, msgID, event.Payload); err != nil {
+			if err := markOutboxFailed(ctx, db, event, err); err != nil {
+				return i, err
+			}
+			if err := releaseOutboxEvents(ctx, db, events[i+1:]); err != nil {
+				return i, err
+			}
+			return i, fmt.Errorf("error publishing outbox event %d: %w", event.ID, err)
+		}
+
+		if _, err := db.ExecContext(ctx, "UPDATE outbox SET sent_at = NOW(), attempts = attempts + 1, locked_until = NULL WHERE id = $1", event.ID); err != nil {
+			return i, fmt.Errorf("error marking outbox event %d as sent: %w", event.ID, err)
+		}
+	}
+
+	return len(events), nil
+}
+
+// claimOutboxBatch claims up to outboxBatchSize pending events for
+// outboxClaimTimeout. Only the oldest ones are taken, up to the first event
+// that waits for a retry or is claimed by another replica. Failed events
+// are skipped.
+func claimOutboxBatch(ctx context.Context, db *sql.DB) ([]outboxEvent, error) {
+	var events []outboxEvent
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		start := time.Now()
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, subject, payload, headers,
+				next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+			FROM outbox
+			WHERE sent_at IS NULL AND failed_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE
+		`, outboxBatchSize)
+		if err != nil {
+			return fmt.Errorf("error querying outbox: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var event outboxEvent
+			var ready bool
+			if err := rows.Scan(&event.ID, &event.Subject, &event.Payload, &event.Headers, &ready); err != nil {
+				return fmt.Errorf("error scanning outbox row: %w", err)
+			}
+			if !ready {
+				break
+			}
+			events = append(events, event)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over outbox rows: %w", err)
+		}
+		rows.Close()
+		observeQuery("select_outbox", start)
+
+		if len(events) == 0 {
+			return nil
+		}
+
+		ids := make([]int64, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE outbox SET locked_until = NOW() + make_interval(secs => $2) WHERE id = ANY($1)", pq.Array(ids), outboxClaimTimeout.Seconds())
+		if err != nil {
+			return fmt.Errorf("error claiming outbox events: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// releaseOutboxEvents hands claimed but unpublished events back.
+func releaseOutboxEvents(ctx context.Context, db *sql.DB, events []outboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE outbox SET locked_until = NULL WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return fmt.Errorf("error releasing outbox events: %w", err)
+	}
+	return nil
+}
+
+// traceContext returns ctx carrying the trace and request ID of the request
+// that enqueued the event, so the publish shows up in the same trace.
+func (e outboxEvent) traceContext(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal(e.Headers, &carrier); err != nil {
+		return ctx
+	}
+	if id := carrier.Get(logging.RequestIDHeader); id != "" {
+		ctx = logging.WithRequestID(ctx, id)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// markOutboxFailed schedules a retry with exponential backoff capped at five
+// minutes. After outboxMaxAttempts the event is marked failed instead and
+// stays in the outbox until it is retried by hand.
+func markOutboxFailed(ctx context.Context, db *sql.DB, event outboxEvent, cause error) error {
+	var failed bool
+	err := db.QueryRowContext(ctx, `
+		UPDATE outbox
+		SET attempts = attempts + 1,
+			last_error = $2,
+			next_attempt_at = NOW() + make_interval(secs => LEAST(POWER(2, attempts), 300)),
+			failed_at = CASE WHEN attempts + 1 >= $3 THEN NOW() END,
+			locked_until = NULL
+		WHERE id = $1
+		RETURNING failed_at IS NOT NULL
+	`, event.ID, cause.Error(), outboxMaxAttempts).Scan(&failed)
+	if err != nil {
+		return fmt.Errorf("error rescheduling outbox event %d: %w", event.ID, err)
+	}
+	if failed {
+		slog.Error("Giving up on outbox event", "id", event.ID, "subject", event.Subject, "attempts", outboxMaxAttempts, "error", cause)
+	}
+	return nil
+}
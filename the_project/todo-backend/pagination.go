@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPostsLimit = 50
+	maxPostsLimit     = 200
+)
+
+// postSorts maps the public ?sort= values to their ORDER BY column.
+var postSorts = map[string]string{
+	"id":    "id",
+	"-id":   "id",
+	"body":  "body",
+	"-body": "body",
+}
+
+type postQuery struct {
+	// Owner limits the query to the todos of a single user.
+	Owner  string
+	Done   *bool
+	Search string
+	Limit  int
+	Sort   string
+	After  *postCursor
+}
+
+// postCursor is the keyset position of the last post on a page. It is
+// handed to clients as an opaque base64 string.
+type postCursor struct {
+	Sort string `json:"s"`
+	ID   int    `json:"id"`
+	Body string `json:"b,omitempty"`
+}
+
+func (c postCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePostCursor(s string) (*postCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var c postCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	// Cursors only move within the caller's own todos, but an edited one
+	// should still fail instead of building a nonsense query.
+	if _, ok := postSorts[c.Sort]; !ok || c.ID < 1 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+func parsePostQuery(values url.Values) (postQuery, error) {
+	q := postQuery{
+		Limit:  defaultPostsLimit,
+		Sort:   "id",
+		Search: values.Get("q"),
+	}
+
+	if done := values.Get("done"); done != "" {
+		parsed, err := strconv.ParseBool(done)
+		if err != nil {
+			return q, fmt.Errorf("'done' must be true or false")
+		}
+		q.Done = &parsed
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > maxPostsLimit {
+			return q, fmt.Errorf("'limit' must be between 1 and %d", maxPostsLimit)
+		}
+		q.Limit = parsed
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := postSorts[sort]; !ok {
+			return q, fmt.Errorf("'sort' must be one of id, -id, body, -body")
+		}
+		q.Sort = sort
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodePostCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+		if after.Sort != q.Sort {
+			return q, fmt.Errorf("cursor does not match sort %q", q.Sort)
+		}
+		q.After = after
+	}
+
+	return q, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sql builds the SELECT for the query. One extra row is fetched so the
+// caller can tell whether there is a next page.
+func (q postQuery) sql() (string, []any) {
+	var where []string
+	var args []any
+
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where = append(where, "owner = "+arg(q.Owner))
+
+	if q.Done != nil {
+		where = append(where, "done = "+arg(*q.Done))
+	}
+
+	if q.Search != "" {
+		where = append(where, "body ILIKE "+arg("%"+escapeLike(q.Search)+"%"))
+	}
+
+	desc := strings.HasPrefix(q.Sort, "-")
+	column := postSorts[q.Sort]
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if q.After != nil {
+		if column == "id" {
+			where = append(where, fmt.Sprintf("id %s %s", cmp, arg(q.After.ID)))
+		} else {
+			where = append(where, fmt.Sprintf("(body, id) %s (%s, %s)", cmp, arg(q.After.Body), arg(q.After.ID)))
+		}
+	}
+
+	query := "SELECT id, body, done, owner FROM posts"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	if column == "id" {
+		query += fmt.Sprintf(" ORDER BY id %s", dir)
+	} else {
+		query += fmt.Sprintf(" ORDER BY body %s, id %s", dir, dir)
+	}
+	query += " LIMIT " + arg(q.Limit+1)
+
+	return query, args
+}
+
+func (q postQuery) cursorFor(post Post) string {
+	c := postCursor{Sort: q.Sort, ID: post.ID}
+	if postSorts[q.Sort] == "body" {
+		c.Body = post.Body
+	}
+	return c.encode()
+}
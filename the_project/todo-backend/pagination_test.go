@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPostCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor postCursor
+	}{
+		{name: "by id", cursor: postCursor{Sort: "id", ID: 42}},
+		{name: "by id descending", cursor: postCursor{Sort: "-id", ID: 1}},
+		{name: "by body", cursor: postCursor{Sort: "body", ID: 7, Body: "Buy milk"}},
+		{name: "by body with special characters", cursor: postCursor{Sort: "-body", ID: 7, Body: "50% \"off\" _ünï_ \\ /?&="}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := tt.cursor.encode()
+			if url.QueryEscape(encoded) != encoded {
+				t.Errorf("encode() = %q, not safe in a query string", encoded)
+			}
+
+			decoded, err := decodePostCursor(encoded)
+			if err != nil {
+				t.Fatalf("decodePostCursor() error = %v", err)
+			}
+			if *decoded != tt.cursor {
+				t.Errorf("decodePostCursor() = %+v, want %+v", *decoded, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestParsePostQueryCursor(t *testing.T) {
+	raw := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	tests := []struct {
+		name    string
+		values  url.Values
+		want    *postCursor
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			values: url.Values{"sort": {"body"}, "cursor": {postCursor{Sort: "body", ID: 3, Body: "b"}.encode()}},
+			want:   &postCursor{Sort: "body", ID: 3, Body: "b"},
+		},
+		{name: "not base64", values: url.Values{"cursor": {"not a cursor!"}}, wantErr: "invalid cursor"},
+		{name: "padded base64", values: url.Values{"cursor": {base64.URLEncoding.EncodeToString([]byte(`{"s":"id","id":1}`))}}, wantErr: "invalid cursor"},
+		{name: "not JSON", values: url.Values{"cursor": {raw("id=1")}}, wantErr: "invalid cursor"},
+		{name: "wrong type", values: url.Values{"cursor": {raw(`{"s":"id","id":"1"}`)}}, wantErr: "invalid cursor"},
+		{name: "unknown sort", values: url.Values{"cursor": {raw(`{"s":"owner","id":1}`)}}, wantErr: "invalid cursor"},
+		{name: "missing id", values: url.Values{"cursor": {raw(`{"s":"id"}`)}}, wantErr: "invalid cursor"},
+		{name: "negative id", values: url.Values{"cursor": {raw(`{"s":"id","id":-1}`)}}, wantErr: "invalid cursor"},
+		{
+			name:    "sort changed",
+			values:  url.Values{"sort": {"-id"}, "cursor": {postCursor{Sort: "id", ID: 3}.encode()}},
+			wantErr: `cursor does not match sort "-id"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parsePostQuery(tt.values)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePostQuery() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePostQuery() error = %v", err)
+			}
+			if !reflect.DeepEqual(q.After, tt.want) {
+				t.Errorf("After = %+v, want %+v", q.After, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostQuerySQL(t *testing.T) {
+	done := true
+
+	tests := []struct {
+		name     string
+		query    postQuery
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:     "first page",
+			query:    postQuery{Owner: "alice", Limit: 10, Sort: "id"},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 ORDER BY id ASC LIMIT $2",
+			wantArgs: []any{"alice", 11},
+		},
+		{
+			name:     "after id",
+			query:    postQuery{Owner: "alice", Limit: 10, Sort: "id", After: &postCursor{Sort: "id", ID: 5}},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 AND id > $2 ORDER BY id ASC LIMIT $3",
+			wantArgs: []any{"alice", 5, 11},
+		},
+		{
+			name:     "after id descending",
+			query:    postQuery{Owner: "alice", Limit: 10, Sort: "-id", After: &postCursor{Sort: "-id", ID: 5}},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 AND id < $2 ORDER BY id DESC LIMIT $3",
+			wantArgs: []any{"alice", 5, 11},
+		},
+		{
+			name:     "after body",
+			query:    postQuery{Owner: "alice", Limit: 10, Sort: "body", After: &postCursor{Sort: "body", ID: 5, Body: "milk"}},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 AND (body, id) > ($2, $3) ORDER BY body ASC, id ASC LIMIT $4",
+			wantArgs: []any{"alice", "milk", 5, 11},
+		},
+		{
+			name:     "after body descending",
+			query:    postQuery{Owner: "alice", Limit: 10, Sort: "-body", After: &postCursor{Sort: "-body", ID: 5, Body: "milk"}},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 AND (body, id) < ($2, $3) ORDER BY body DESC, id DESC LIMIT $4",
+			wantArgs: []any{"alice", "milk", 5, 11},
+		},
+		{
+			name:     "filters",
+			query:    postQuery{Owner: "alice", Done: &done, Search: `50%_off\`, Limit: 10, Sort: "id", After: &postCursor{Sort: "id", ID: 5}},
+			wantSQL:  "SELECT id, body, done, owner FROM posts WHERE owner = $1 AND done = $2 AND body ILIKE $3 AND id > $4 ORDER BY id ASC LIMIT $5",
+			wantArgs: []any{"alice", true, `%50\%\_off\\%`, 5, 11},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSQL, gotArgs := tt.query.sql()
+			if gotSQL != tt.wantSQL {
+				t.Errorf("sql() =\n%s\nwant\n%s", gotSQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(gotArgs, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", gotArgs, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCursorForContinuesQuery(t *testing.T) {
+	q := postQuery{Owner: "alice", Limit: 2, Sort: "-body"}
+	cursor := q.cursorFor(Post{ID: 9, Body: "milk"})
+
+	next, err := parsePostQuery(url.Values{"sort": {"-body"}, "limit": {"2"}, "cursor": {cursor}})
+	if err != nil {
+		t.Fatalf("parsePostQuery() error = %v", err)
+	}
+	next.Owner = q.Owner
+
+	_, args := next.sql()
+	want := []any{"alice", "milk", 9, 3}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %#v, want %#v", args, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	todosStream  = "TODOS"
+	consumerName = "broadcaster"
+	// maxDeliver is how many times a message is tried before JetStream gives
+	// up on it.
+	maxDeliver = 5
+	tracerName = "todo-broadcaster"
+)
+
+var todoSubjects = []string{"todo.created", "todo.updated", "todo.deleted"}
+
+// natsHeaderCarrier lets the OTel propagator read and write NATS message
+// headers.
+type natsHeaderCarrier nats.Header
+
+func (c natsHeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c natsHeaderCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// redeliveryBackoff is the delay before each redelivery of a nacked message.
+var redeliveryBackoff = []time.Duration{5 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute}
+
+func redeliveryDelay(numDelivered uint64) time.Duration {
+	if numDelivered == 0 {
+		return redeliveryBackoff[0]
+	}
+	i := min(int(numDelivered-1), len(redeliveryBackoff)-1)
+	return redeliveryBackoff[i]
+}
+
+// todosStreamConfig must stay in sync with the one declared by todo-backend.
+var todosStreamConfig = jetstream.StreamConfig{
+	Name:       todosStream,
+	Subjects:   []string{"todo.>"},
+	Storage:    jetstream.FileStorage,
+	Retention:  jetstream.LimitsPolicy,
+	MaxAge:     7 * 24 * time.Hour,
+	Duplicates: 10 * time.Minute,
+}
+
+// setupConsumer declares the TODOS stream and the durable pull consumer
+// shared by all broadcaster replicas.
+func setupConsumer(ctx context.Context, js jetstream.JetStream) (jetstream.Consumer, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := js.CreateOrUpdateStream(ctx, todosStreamConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare stream %s: %w", todosStream, err)
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:        consumerName,
+		FilterSubjects: todoSubjects,
+		DeliverPolicy:  jetstream.DeliverAllPolicy,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		// AckWait must outlast the in-process retries of one delivery.
+		AckWait:    3 * time.Minute,
+		MaxDeliver: maxDeliver,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare consumer %s: %w", consumerName, err)
+	}
+
+	return consumer, nil
+}
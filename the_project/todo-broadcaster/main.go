@@ -1,14 +1,29 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/config"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/health"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/logging"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/tracing"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TodoIncoming struct {
@@ -17,124 +32,245 @@ type TodoIncoming struct {
 	Done bool   `json:"done"`
 }
 
-type TelegramMessage struct {
-	ChatID string `json:"chat_id"`
-	Text   string `json:"text"`
+// Config is the broadcaster configuration, loaded by the config
+// package.
+type Config struct {
+	Port    string `env:"PORT" yaml:"port" required:"true" validate:"port"`
+	NATSURL string `env:"NATS_URL" yaml:"nats_url" required:"true" validate:"url"`
+	AppEnv  string `env:"APP_ENV" yaml:"app_env" required:"true"`
+	// TemplatesDir overrides the embedded message templates.
+	TemplatesDir string `env:"TEMPLATES_DIR" yaml:"templates_dir"`
+	// User is who the notifications are sent as.
+	User     string          `env:"USER" yaml:"user" default:"broadcaster"`
+	Notify   notifierConfig  `yaml:"notify"`
+	Health   health.Config   `yaml:"health"`
+	Shutdown shutdown.Config `yaml:"shutdown"`
 }
 
-var appEnv string
+func (c Config) Validate() []string {
+	return c.Notify.validate(c.AppEnv)
+}
+
+// shuttingDown fails the readiness check while the broadcaster drains.
+var shuttingDown atomic.Bool
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		panic("Environmental variable PORT is not set")
-	}
+	logging.Setup("todo-broadcaster")
 
-	natsURL := os.Getenv("NATS_URL")
-	if natsURL == "" {
-		panic("Environmental variable NATS_URL is not set")
+	var cfg Config
+	config.MustLoad(&cfg, os.Args[1:])
+
+	if err := run(cfg); err != nil {
+		slog.Error("Broadcaster failed", "error", err)
+		os.Exit(1)
 	}
+}
+
+func run(cfg Config) error {
+	notifier := newNotifier(cfg.AppEnv, cfg.Notify)
 
-	appEnv = os.Getenv("APP_ENV")
-	if appEnv == "" {
-		panic("Environmental variable APP_ENV is not set")
+	templates, err := newMessageTemplates(cfg.TemplatesDir, cfg.Notify.Telegram.ParseMode)
+	if err == nil {
+		err = templates.validate()
+	}
+	if err != nil {
+		return fmt.Errorf("invalid message templates: %w", err)
 	}
 
-	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
-	chatID := os.Getenv("TELEGRAM_CHAT_ID")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if appEnv == "production" && (botToken == "" || chatID == "") {
-		panic("TELEGRAM_BOT_TOKEN and TELEGRAM_CHAT_ID environment variables must be set in production")
+	shutdownTracing, err := tracing.Setup(ctx, "todo-broadcaster")
+	if err != nil {
+		return err
 	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
 
-	log.Printf("Starting broadcaster in %s mode", appEnv)
-	log.Printf("Connecting to NATS at %s...", natsURL)
-	nc, err := nats.Connect(natsURL)
+	slog.Info("Starting broadcaster", "app_env", cfg.AppEnv)
+	slog.Info("Connecting to NATS", "url", cfg.NATSURL)
+	nc, err := nats.Connect(cfg.NATSURL)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer nc.Close()
-	log.Println("Connected to NATS.")
+	slog.Info("Connected to NATS")
 
 	hostname, _ := os.Hostname()
-	user := os.Getenv("USER")
-	if user == "" {
-		user = "broadcaster"
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
 	}
 
-	log.Println("Subscribing to todo.created and todo.updated subjects...")
-	_, err = nc.QueueSubscribe("todo.created", "broadcaster_workers", func(m *nats.Msg) {
-		sendMessage(nc, m, "created", botToken, chatID, user, hostname)
-	})
+	consumer, err := setupConsumer(ctx, js)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	_, err = nc.QueueSubscribe("todo.updated", "broadcaster_workers", func(m *nats.Msg) {
-		sendMessage(nc, m, "updated", botToken, chatID, user, hostname)
-	})
+	b := &Broadcaster{
+		JS:        js,
+		Notifier:  notifier,
+		Templates: templates,
+		Tracker:   newDeliveryTracker(),
+		User:      cfg.User,
+		Hostname:  hostname,
+	}
+
+	slog.Info("Consuming todo events", "subjects", todoSubjects, "stream", todosStream, "consumer", consumerName)
+	consumeCtx, err := consumer.Consume(b.handleMessage)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	log.Println("Broadcaster is running. Waiting for messages...")
+	slog.Info("Broadcaster is running. Waiting for messages")
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, "alive\n")
-	})
-	addr := ":" + port
-	fmt.Printf("Server started in port %s\n", port)
+	checker := health.NewChecker(cfg.Health, &shuttingDown,
+		health.Check{Name: "nats", Check: func(context.Context) error {
+			if status := nc.Status(); status != nats.CONNECTED {
+				return fmt.Errorf("NATS connection is %s", status)
+			}
+			return nil
+		}},
+		health.Check{Name: "consumer", Check: func(ctx context.Context) error {
+			_, err := consumer.Info(ctx)
+			return err
+		}},
+	)
+	mux.HandleFunc("/livez", checker.HandleLive)
+	mux.HandleFunc("/readyz", checker.HandleReady)
+	mux.HandleFunc("/healthz", checker.HandleReady)
+
+	addr := ":" + cfg.Port
+	slog.Info("Server started", "port", cfg.Port)
+
+	srv := &http.Server{Addr: addr, Handler: logging.Requests(mux)}
+	err = shutdown.Serve(ctx, srv, cfg.Shutdown, func() { shuttingDown.Store(true) })
 
-	http.ListenAndServe(addr, mux)
+	drainNATS(nc, consumeCtx, cfg.Shutdown)
+	return err
 }
 
-func sendMessage(nc *nats.Conn, m *nats.Msg, action string, token, chatID, user, hostname string) {
-	var todo TodoIncoming
+// Broadcaster turns todo events from JetStream into notifications.
+type Broadcaster struct {
+	JS        jetstream.JetStream
+	Notifier  multiNotifier
+	Templates *messageTemplates
+	Tracker   *deliveryTracker
+	User      string
+	Hostname  string
+}
 
-	if err := json.Unmarshal(m.Data, &todo); err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
-		return
+// handleMessage acks a message once it was broadcast. Failed sends are
+// redelivered by JetStream with a delay; after maxDeliver attempts, or on a
+// permanent error, the message is moved to todo.deadletter. The span
+// continues the trace todo-backend sent in the message headers.
+func (b *Broadcaster) handleMessage(msg jetstream.Msg) {
+	action := strings.TrimPrefix(msg.Subject(), "todo.")
+
+	var seq, attempt uint64
+	if meta, err := msg.Metadata(); err == nil {
+		seq, attempt = meta.Sequence.Stream, meta.NumDelivered
 	}
 
-	log.Printf("Received todo.%s: %s", action, todo.Body)
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), natsHeaderCarrier(msg.Headers()))
+	if id := msg.Headers().Get(logging.RequestIDHeader); logging.ValidRequestID(id) {
+		ctx = logging.WithRequestID(ctx, id)
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "process "+msg.Subject(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", msg.Subject()),
+			attribute.String("messaging.consumer.group.name", consumerName),
+			attribute.Int64("messaging.nats.stream_sequence", int64(seq)),
+			attribute.Int64("messaging.nats.delivery_count", int64(attempt)),
+		),
+	)
+	defer span.End()
 
-	prettyJSON, _ := json.MarshalIndent(todo, "", "  ")
+	var todo TodoIncoming
+	if err := json.Unmarshal(msg.Data(), &todo); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling JSON", "subject", msg.Subject(), "seq", seq, "error", err)
+		span.SetStatus(codes.Error, "invalid payload")
+		b.deadLetter(ctx, msg, seq, attempt, fmt.Errorf("invalid payload: %w", err))
+		return
+	}
 
-	message := fmt.Sprintf("A todo was %s:\n%s\n\nbroadcasted by %s @ %s",
-		action,
-		string(prettyJSON),
-		user,
-		hostname,
-	)
-	if appEnv == "staging" {
-		log.Printf("[STAGING] Skip sending message to Telegram:\n```%s\n```", message)
+	err := b.sendMessage(ctx, todo, action, seq)
+	if err == nil {
+		b.Tracker.forget(seq)
+		if err := msg.Ack(); err != nil {
+			slog.ErrorContext(ctx, "Error acking message", "subject", msg.Subject(), "seq", seq, "error", err)
+		}
+		return
+	}
+
+	slog.WarnContext(ctx, "Failed to broadcast todo", "action", action, "todo_id", todo.ID, "attempt", attempt, "max_deliver", maxDeliver, "error", err)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	if isPermanent(err) || attempt >= maxDeliver {
+		b.deadLetter(ctx, msg, seq, attempt, err)
 		return
 	}
 
-	sendToTelegram(token, chatID, message)
+	if err := msg.NakWithDelay(redeliveryDelay(attempt)); err != nil {
+		slog.ErrorContext(ctx, "Error nacking message", "subject", msg.Subject(), "seq", seq, "error", err)
+	}
 }
 
-func sendToTelegram(token string, chatID string, text string) {
-	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token)
+func (b *Broadcaster) deadLetter(ctx context.Context, msg jetstream.Msg, seq, attempt uint64, cause error) {
+	b.Tracker.forget(seq)
 
-	payload := TelegramMessage{
-		ChatID: chatID,
-		Text:   text,
+	if err := publishDeadLetterWithRetry(ctx, b.JS, msg, attempt, cause); err != nil {
+		if attempt < maxDeliver {
+			// A redelivery is left, which tries again.
+			slog.ErrorContext(ctx, "Error moving message to dead letter", "subject", msg.Subject(), "seq", seq, "error", err)
+			if err := msg.NakWithDelay(redeliveryDelay(attempt)); err != nil {
+				slog.ErrorContext(ctx, "Error nacking message", "subject", msg.Subject(), "seq", seq, "error", err)
+			}
+			return
+		}
+		// JetStream won't redeliver it anymore, so the log is all that is
+		// left of it.
+		slog.ErrorContext(ctx, "Dropping message that could not be moved to dead letter", "subject", msg.Subject(), "seq", seq, "data", string(msg.Data()), "cause", cause, "error", err)
+		if err := msg.Term(); err != nil {
+			slog.ErrorContext(ctx, "Error terminating message", "subject", msg.Subject(), "seq", seq, "error", err)
+		}
+		return
 	}
 
-	jsonPayload, _ := json.Marshal(payload)
+	slog.WarnContext(ctx, "Moved message to dead letter", "subject", msg.Subject(), "seq", seq, "dead_letter_subject", deadLetterSubject, "error", cause)
+	if err := msg.Term(); err != nil {
+		slog.ErrorContext(ctx, "Error terminating message", "subject", msg.Subject(), "seq", seq, "error", err)
+	}
+}
+
+func (b *Broadcaster) sendMessage(ctx context.Context, todo TodoIncoming, action string, seq uint64) error {
+	slog.InfoContext(ctx, "Received todo event", "action", action, "todo_id", todo.ID, "seq", seq)
 
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(jsonPayload))
+	message, err := b.Templates.render(MessageData{
+		Action:   action,
+		Todo:     todo,
+		User:     b.User,
+		Hostname: b.Hostname,
+		Time:     time.Now(),
+	})
 	if err != nil {
-		log.Printf("Failed to send to Telegram: %v", err)
-		return
+		return &permanentError{err}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Telegram returned non-OK status: %d", resp.StatusCode)
-	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	return b.Notifier.notifyPending(ctx, Notification{Action: action, Todo: todo, Text: message},
+		func(sink string) bool { return b.Tracker.isDelivered(seq, sink) },
+		func(sink string) { b.Tracker.markDelivered(seq, sink) },
+	)
 }
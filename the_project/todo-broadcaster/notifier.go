@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Notification is a single todo event ready to be delivered to a sink.
+type Notification struct {
+	Action string
+	Todo   TodoIncoming
+	Text   string
+}
+
+// Notifier delivers notifications to one destination.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+// multiNotifier fans a notification out to several sinks.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Name() string {
+	names := make([]string, len(m))
+	for i, n := range m {
+		names[i] = n.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (m multiNotifier) Notify(ctx context.Context, n Notification) error {
+	return m.notifyPending(ctx, n, func(string) bool { return false }, func(string) {})
+}
+
+// notifyPending sends n with retries to every sink for which skip returns
+// false and reports successful sinks to done. It fails permanently only if
+// every failing sink failed permanently.
+func (m multiNotifier) notifyPending(ctx context.Context, n Notification, skip func(string) bool, done func(string)) error {
+	var errs []error
+	permanent := true
+	for _, notifier := range m {
+		if skip(notifier.Name()) {
+			continue
+		}
+		sinkCtx, span := otel.Tracer(tracerName).Start(ctx, "notify "+notifier.Name(),
+			trace.WithAttributes(attribute.String("notifier.sink", notifier.Name())),
+		)
+		err := notifyWithRetry(sinkCtx, notifier, n)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		if err != nil {
+			permanent = permanent && isPermanent(err)
+			errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+			continue
+		}
+		done(notifier.Name())
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		if permanent {
+			return &permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// permanentError marks a delivery that must not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// notifierConfig is the notifications section of the broadcaster
+// configuration. Every sink has its own settings.
+type notifierConfig struct {
+	// Sinks to send to, e.g. NOTIFIERS=telegram,slack,log.
+	Sinks    []string       `env:"NOTIFIERS" yaml:"sinks"`
+	Telegram telegramConfig `yaml:"telegram"`
+	Webhook  webhookConfig  `yaml:"webhook"`
+	Slack    slackConfig    `yaml:"slack"`
+	Email    emailConfig    `yaml:"email"`
+}
+
+// sinks keeps the previous behaviour when NOTIFIERS is not set: staging
+// only logs, every other environment sends to Telegram.
+func (c notifierConfig) sinks(appEnv string) []string {
+	if len(c.Sinks) > 0 {
+		return c.Sinks
+	}
+	if appEnv == "staging" {
+		return []string{"log"}
+	}
+	return []string{"telegram"}
+}
+
+// validate reports unknown sinks and the settings the enabled sinks are
+// missing.
+func (c notifierConfig) validate(appEnv string) []string {
+	var problems []string
+	for _, name := range c.sinks(appEnv) {
+		var required map[string]string
+		switch name {
+		case "telegram":
+			required = map[string]string{"TELEGRAM_BOT_TOKEN": c.Telegram.BotToken, "TELEGRAM_CHAT_ID": c.Telegram.ChatID}
+		case "webhook":
+			required = map[string]string{"WEBHOOK_URL": c.Webhook.URL, "WEBHOOK_SECRET": c.Webhook.Secret}
+		case "slack":
+			required = map[string]string{"SLACK_WEBHOOK_URL": c.Slack.WebhookURL}
+		case "email":
+			required = map[string]string{"SMTP_HOST": c.Email.Host, "SMTP_FROM": c.Email.From, "SMTP_TO": strings.Join(c.Email.To, ",")}
+		case "log":
+		default:
+			problems = append(problems, fmt.Sprintf("NOTIFIERS: unknown notifier %q, expected telegram, webhook, slack, email or log", name))
+		}
+
+		var missing []string
+		for setting, value := range required {
+			if value == "" {
+				missing = append(missing, setting)
+			}
+		}
+		if len(missing) > 0 {
+			slices.Sort(missing)
+			problems = append(problems, fmt.Sprintf("%s notifier requires %s", name, strings.Join(missing, ", ")))
+		}
+	}
+	return problems
+}
+
+// newNotifier builds the configured sinks. cfg must have been validated.
+func newNotifier(appEnv string, cfg notifierConfig) multiNotifier {
+	var notifiers multiNotifier
+	seen := map[string]bool{}
+
+	for _, name := range cfg.sinks(appEnv) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		switch name {
+		case "telegram":
+			notifiers = append(notifiers, newTelegramNotifier(cfg.Telegram))
+		case "webhook":
+			notifiers = append(notifiers, newWebhookNotifier(cfg.Webhook))
+		case "slack":
+			notifiers = append(notifiers, newSlackNotifier(cfg.Slack))
+		case "email":
+			notifiers = append(notifiers, newEmailNotifier(cfg.Email))
+		case "log":
+			notifiers = append(notifiers, logNotifier{prefix: strings.ToUpper(appEnv)})
+		}
+	}
+
+	slog.Info("Notification sinks configured", "sinks", notifiers.Name())
+	return notifiers
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	deadLetterSubject = "todo.deadletter"
+
+	// sendAttempts is how often a sink is tried in-process for one delivery
+	// before the message is handed back to JetStream for a later redelivery.
+	sendAttempts   = 3
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+
+	// deadLetterAttempts is how often a message is offered to
+	// todo.deadletter before it is given up on.
+	deadLetterAttempts = 5
+
+	// trackedDeliveries bounds how many in-flight messages remember which
+	// sinks already succeeded, so redeliveries don't notify them twice.
+	trackedDeliveries = 1000
+)
+
+// statusError is returned by sinks for unsuccessful HTTP responses.
+type statusError struct {
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("received non-OK status: %d (retry after %s)", e.Status, e.RetryAfter)
+	}
+	return fmt.Sprintf("received non-OK status: %d", e.Status)
+}
+
+// isPermanent reports whether retrying err cannot succeed, e.g. a rejected
+// request or bad credentials.
+func isPermanent(err error) bool {
+	var permErr *permanentError
+	if errors.As(err, &permErr) {
+		return true
+	}
+
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.Status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return statusErr.Status >= 400 && statusErr.Status < 500
+}
+
+func retryAfterOf(err error) time.Duration {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads the Retry-After header, either in seconds or as an
+// HTTP date.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// deadLetterBackoff is the delay between dead letter attempts.
+var deadLetterBackoff = backoffDelay
+
+func backoffDelay(attempt int) time.Duration {
+	delay := min(retryBaseDelay<<attempt, retryMaxDelay)
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// notifyWithRetry retries a single sink with exponential backoff. A
+// Retry-After from the sink takes precedence over the computed delay.
+func notifyWithRetry(ctx context.Context, notifier Notifier, n Notification) error {
+	var err error
+	for attempt := range sendAttempts {
+		if err = notifier.Notify(ctx, n); err == nil || isPermanent(err) {
+			return err
+		}
+
+		if attempt == sendAttempts-1 {
+			break
+		}
+
+		delay := backoffDelay(attempt)
+		if retryAfter := retryAfterOf(err); retryAfter > 0 {
+			delay = retryAfter
+		}
+		slog.WarnContext(ctx, "Sending notification failed, retrying", "sink", notifier.Name(), "action", n.Action, "todo_id", n.Todo.ID, "retry_in", delay.Round(time.Millisecond).String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
+
+// deliveryTracker remembers per stream sequence which sinks already got a
+// message. The oldest entries are dropped once it is full.
+type deliveryTracker struct {
+	mu        sync.Mutex
+	delivered map[uint64]map[string]bool
+	order     []uint64
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{delivered: map[uint64]map[string]bool{}}
+}
+
+func (t *deliveryTracker) isDelivered(seq uint64, sink string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delivered[seq][sink]
+}
+
+func (t *deliveryTracker) markDelivered(seq uint64, sink string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sinks, ok := t.delivered[seq]
+	if !ok {
+		if len(t.order) >= trackedDeliveries {
+			delete(t.delivered, t.order[0])
+			t.order = t.order[1:]
+		}
+		sinks = map[string]bool{}
+		t.delivered[seq] = sinks
+		t.order = append(t.order, seq)
+	}
+	sinks[sink] = true
+}
+
+func (t *deliveryTracker) forget(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.delivered, seq)
+}
+
+type deadLetter struct {
+	Subject    string          `json:"subject"`
+	Data       json.RawMessage `json:"data"`
+	Error      string          `json:"error"`
+	Deliveries uint64          `json:"deliveries"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// publishDeadLetter stores a notification that permanently failed on
+// todo.deadletter, which is part of the TODOS stream.
+func publishDeadLetter(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, deliveries uint64, cause error) error {
+	data := json.RawMessage(msg.Data())
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(msg.Data()))
+	}
+
+	payload, err := json.Marshal(deadLetter{
+		Subject:    msg.Subject(),
+		Data:       data,
+		Error:      cause.Error(),
+		Deliveries: deliveries,
+		FailedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	dlMsg := nats.NewMsg(deadLetterSubject)
+	dlMsg.Data = payload
+	otel.GetTextMapPropagator().Inject(ctx, natsHeaderCarrier(dlMsg.Header))
+
+	if _, err := js.PublishMsg(ctx, dlMsg); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", deadLetterSubject, err)
+	}
+	return nil
+}
+
+// publishDeadLetterWithRetry retries publishDeadLetter with backoff. The
+// message is kept in progress meanwhile, so JetStream doesn't count the
+// wait as another failed delivery.
+func publishDeadLetterWithRetry(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg, deliveries uint64, cause error) error {
+	var err error
+	for attempt := range deadLetterAttempts {
+		if err = publishDeadLetter(ctx, js, msg, deliveries, cause); err == nil {
+			return nil
+		}
+
+		if attempt == deadLetterAttempts-1 {
+			break
+		}
+
+		if err := msg.InProgress(); err != nil {
+			slog.WarnContext(ctx, "Error extending the ack deadline", "subject", msg.Subject(), "error", err)
+		}
+		delay := deadLetterBackoff(attempt)
+		slog.WarnContext(ctx, "Moving message to dead letter failed, retrying", "subject", msg.Subject(), "retry_in", delay.Round(time.Millisecond).String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeJetStream fails the first failures publishes and records the rest.
+type fakeJetStream struct {
+	jetstream.JetStream
+	failures  int
+	calls     int
+	published []*nats.Msg
+}
+
+func (js *fakeJetStream) PublishMsg(_ context.Context, msg *nats.Msg, _ ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	js.calls++
+	if js.calls <= js.failures {
+		return nil, errors.New("nats: timeout")
+	}
+	js.published = append(js.published, msg)
+	return &jetstream.PubAck{Stream: "TODOS"}, nil
+}
+
+// fakeMsg records how a message was settled.
+type fakeMsg struct {
+	jetstream.Msg
+	inProgress int
+	naks       int
+	terms      int
+}
+
+func (m *fakeMsg) Subject() string      { return "todo.created" }
+func (m *fakeMsg) Data() []byte         { return []byte(`{"id":1,"body":"Buy milk"}`) }
+func (m *fakeMsg) Headers() nats.Header { return nats.Header{} }
+func (m *fakeMsg) InProgress() error    { m.inProgress++; return nil }
+func (m *fakeMsg) Term() error          { m.terms++; return nil }
+
+func (m *fakeMsg) NakWithDelay(time.Duration) error {
+	m.naks++
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	prev := deadLetterBackoff
+	deadLetterBackoff = func(int) time.Duration { return time.Millisecond }
+	defer func() { deadLetterBackoff = prev }()
+
+	tests := []struct {
+		name           string
+		failures       int
+		attempt        uint64
+		wantPublished  bool
+		wantInProgress int
+		wantNaks       int
+		wantTerms      int
+	}{
+		{name: "published", attempt: maxDeliver, wantPublished: true, wantTerms: 1},
+		{name: "published after retries on the last delivery", failures: deadLetterAttempts - 1, attempt: maxDeliver, wantPublished: true, wantInProgress: deadLetterAttempts - 1, wantTerms: 1},
+		{name: "redelivered while deliveries are left", failures: deadLetterAttempts, attempt: 1, wantInProgress: deadLetterAttempts - 1, wantNaks: 1},
+		{name: "dropped on the last delivery", failures: deadLetterAttempts, attempt: maxDeliver, wantInProgress: deadLetterAttempts - 1, wantTerms: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			js := &fakeJetStream{failures: tt.failures}
+			msg := &fakeMsg{}
+			b := &Broadcaster{JS: js, Tracker: newDeliveryTracker()}
+
+			b.deadLetter(context.Background(), msg, 7, tt.attempt, errors.New("sink failed"))
+
+			if got := len(js.published) == 1; got != tt.wantPublished {
+				t.Fatalf("published %d dead letters, want published %v", len(js.published), tt.wantPublished)
+			}
+			if msg.inProgress != tt.wantInProgress || msg.naks != tt.wantNaks || msg.terms != tt.wantTerms {
+				t.Errorf("in progress %d, naks %d, terms %d, want %d, %d, %d", msg.inProgress, msg.naks, msg.terms, tt.wantInProgress, tt.wantNaks, tt.wantTerms)
+			}
+			if !tt.wantPublished {
+				return
+			}
+
+			dlMsg := js.published[0]
+			if dlMsg.Subject != deadLetterSubject {
+				t.Errorf("subject = %q, want %q", dlMsg.Subject, deadLetterSubject)
+			}
+			var dl deadLetter
+			if err := json.Unmarshal(dlMsg.Data, &dl); err != nil {
+				t.Fatal(err)
+			}
+			if dl.Subject != "todo.created" || dl.Error != "sink failed" || dl.Deliveries != tt.attempt || string(dl.Data) != `{"id":1,"body":"Buy milk"}` {
+				t.Errorf("dead letter = %+v", dl)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/shutdown"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// drainNATS stops fetching new messages, lets in-flight ones finish and
+// drains the connection, waiting at most cfg.Timeout for each step.
+func drainNATS(nc *nats.Conn, consumeCtx jetstream.ConsumeContext, cfg shutdown.Config) {
+	timeout := cfg.Timeout
+
+	slog.Info("Draining JetStream consumer")
+	consumeCtx.Drain()
+	select {
+	case <-consumeCtx.Closed():
+	case <-time.After(timeout):
+		slog.Warn("Timed out draining JetStream consumer")
+	}
+
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) {
+		close(closed)
+	})
+
+	slog.Info("Draining NATS connection")
+	if err := nc.Drain(); err != nil {
+		slog.Error("Error draining NATS connection", "error", err)
+		return
+	}
+	select {
+	case <-closed:
+		slog.Info("NATS connection drained")
+	case <-time.After(timeout):
+		slog.Warn("Timed out draining NATS connection")
+	}
+}
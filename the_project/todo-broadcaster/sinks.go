@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kirillstrelkov/KubernetesSubmissions/common/tracing"
+)
+
+var httpClient = tracing.Client(&http.Client{Timeout: 10 * time.Second})
+
+// secretURLClient is used for URLs that are secrets themselves, the
+// Telegram API with the bot token and Slack webhooks. It is not traced, the
+// client span would record the URL; the notify span still covers the call.
+var secretURLClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload any, headers map[string]string) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", withoutURL(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", withoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp)}
+	}
+	return nil
+}
+
+type TelegramMessage struct {
+	ChatID    string `json:"chat_id"`
+	Text      string `json:"text"`
+	ParseMode string `json:"parse_mode,omitempty"`
+}
+
+type telegramConfig struct {
+	BotToken string `env:"TELEGRAM_BOT_TOKEN" yaml:"bot_token" secret:"true"`
+	ChatID   string `env:"TELEGRAM_CHAT_ID" yaml:"chat_id"`
+	// ParseMode must match the markup of custom message templates; their
+	// escape function follows it.
+	ParseMode string `env:"TELEGRAM_PARSE_MODE" yaml:"parse_mode" validate:"oneof=MarkdownV2 HTML"`
+}
+
+type telegramNotifier struct {
+	token     string
+	chatID    string
+	parseMode string
+}
+
+func newTelegramNotifier(cfg telegramConfig) Notifier {
+	return &telegramNotifier{token: cfg.BotToken, chatID: cfg.ChatID, parseMode: cfg.ParseMode}
+}
+
+func (t *telegramNotifier) Name() string { return "telegram" }
+
+// telegramError is the body Telegram sends with failed requests. Rate
+// limited requests carry the wait time in parameters.retry_after.
+type telegramError struct {
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+func (t *telegramNotifier) Notify(ctx context.Context, n Notification) error {
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.token)
+
+	jsonPayload, err := json.Marshal(TelegramMessage{ChatID: t.chatID, Text: n.Text, ParseMode: t.parseMode})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", withoutURL(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := secretURLClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send to Telegram: %w", withoutURL(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	statusErr := &statusError{Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp)}
+	var tgErr telegramError
+	if err := json.NewDecoder(resp.Body).Decode(&tgErr); err == nil {
+		if tgErr.Parameters.RetryAfter > 0 {
+			statusErr.RetryAfter = time.Duration(tgErr.Parameters.RetryAfter) * time.Second
+		}
+		if tgErr.Description != "" {
+			return fmt.Errorf("telegram: %s: %w", tgErr.Description, statusErr)
+		}
+	}
+	return statusErr
+}
+
+// withoutURL drops the URL from err, so secrets in it like the bot token
+// don't end up in logs, spans and dead letters.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+type webhookConfig struct {
+	URL    string `env:"WEBHOOK_URL" yaml:"url" validate:"url"`
+	Secret string `env:"WEBHOOK_SECRET" yaml:"secret" secret:"true"`
+}
+
+// webhookNotifier POSTs the event as JSON. The body is signed with
+// HMAC-SHA256 so receivers can verify it came from the broadcaster.
+type webhookNotifier struct {
+	url    string
+	secret []byte
+}
+
+type webhookPayload struct {
+	Event string       `json:"event"`
+	Todo  TodoIncoming `json:"todo"`
+	Text  string       `json:"text"`
+	Sent  time.Time    `json:"sent_at"`
+}
+
+func newWebhookNotifier(cfg webhookConfig) Notifier {
+	return &webhookNotifier{url: cfg.URL, secret: []byte(cfg.Secret)}
+}
+
+func (w *webhookNotifier) Name() string { return "webhook" }
+
+func (w *webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(webhookPayload{
+		Event: "todo." + n.Action,
+		Todo:  n.Todo,
+		Text:  n.Text,
+		Sent:  time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	return postJSON(ctx, httpClient, w.url, json.RawMessage(body), map[string]string{
+		"X-Todo-Event":         "todo." + n.Action,
+		"X-Todo-Signature-256": signature,
+	})
+}
+
+type slackConfig struct {
+	// The webhook URL is a credential by itself.
+	WebhookURL string `env:"SLACK_WEBHOOK_URL" yaml:"webhook_url" secret:"true" validate:"url"`
+}
+
+// slackNotifier sends to a Slack compatible incoming webhook, which also
+// works for Mattermost and Rocket.Chat.
+type slackNotifier struct {
+	url string
+}
+
+func newSlackNotifier(cfg slackConfig) Notifier {
+	return &slackNotifier{url: cfg.WebhookURL}
+}
+
+func (s *slackNotifier) Name() string { return "slack" }
+
+func (s *slackNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, secretURLClient, s.url, map[string]string{"text": n.Text}, nil)
+}
+
+type emailConfig struct {
+	Host     string   `env:"SMTP_HOST" yaml:"host"`
+	Port     string   `env:"SMTP_PORT" yaml:"port" default:"587" validate:"port"`
+	Username string   `env:"SMTP_USERNAME" yaml:"username"`
+	Password string   `env:"SMTP_PASSWORD" yaml:"password" secret:"true"`
+	From     string   `env:"SMTP_FROM" yaml:"from"`
+	To       []string `env:"SMTP_TO" yaml:"to"`
+}
+
+type emailNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func newEmailNotifier(cfg emailConfig) Notifier {
+	return &emailNotifier{
+		addr:     net.JoinHostPort(cfg.Host, cfg.Port),
+		host:     cfg.Host,
+		username: cfg.Username,
+		password: cfg.Password,
+		from:     cfg.From,
+		to:       cfg.To,
+	}
+}
+
+func (e *emailNotifier) Name() string { return "email" }
+
+func (e *emailNotifier) Notify(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	// Headers must be ASCII, a todo in another language becomes an encoded
+	// word.
+	subject := fmt.Sprintf("Todo %s: %s", n.Action, strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Todo.Body))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n"))
+
+	if err := e.send(ctx, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
+
+// send is smtp.SendMail bound to ctx: the connection is closed once ctx is
+// done, so a stuck mail server can't hold up the message past its timeout.
+func (e *emailNotifier) send(ctx context.Context, msg []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = e.session(conn, msg)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+func (e *emailNotifier) session(conn net.Conn, msg []byte) error {
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, e.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// logNotifier only writes the message to stdout.
+type logNotifier struct {
+	prefix string
+}
+
+func (l logNotifier) Name() string { return "log" }
+
+func (l logNotifier) Notify(ctx context.Context, n Notification) error {
+	slog.InfoContext(ctx, "Notification", "prefix", l.prefix, "action", n.Action, "todo_id", n.Todo.ID, "text", n.Text)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithoutURL(t *testing.T) {
+	const token = "123456:secret-token"
+	apiURL := "https://api.telegram.org/bot" + token + "/sendMessage"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sendErr := http.DefaultClient.Do(req)
+	_, parseErr := http.NewRequest(http.MethodPost, apiURL+"\x7f", nil)
+
+	tests := []struct {
+		name   string
+		err    error
+		wantIs error
+	}{
+		{name: "send error", err: sendErr, wantIs: context.Canceled},
+		{name: "parse error", err: parseErr},
+		{name: "other error", err: errors.New("something else")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("expected an error to redact")
+			}
+			got := withoutURL(tt.err)
+			if strings.Contains(got.Error(), token) {
+				t.Errorf("withoutURL() = %q, still contains the token", got)
+			}
+			if tt.wantIs != nil && !errors.Is(got, tt.wantIs) {
+				t.Errorf("withoutURL() = %v, want it to wrap %v", got, tt.wantIs)
+			}
+		})
+	}
+}
+
+// fakeSMTP accepts one connection and answers like a mail server without
+// extensions. With hang it greets and then stops answering. The message
+// is sent on the returned channel.
+func fakeSMTP(t *testing.T, hang bool) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 fake ESMTP")
+		if hang {
+			// Read until the client gives up and closes the connection.
+			bufio.NewReader(conn).WriteTo(&strings.Builder{})
+			return
+		}
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received <- string(data)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestEmailNotifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		hang        bool
+		timeout     time.Duration
+		wantSubject string
+		wantErr     error
+	}{
+		{name: "delivers", body: "Buy\nmilk", timeout: 5 * time.Second, wantSubject: "Subject: Todo created: Buy milk\n"},
+		{name: "encodes a non-ASCII subject", body: "Köp mjölk ☕", timeout: 5 * time.Second, wantSubject: "Subject: =?utf-8?q?Todo_created:_K=C3=B6p_mj=C3=B6lk_=E2=98=95?=\n"},
+		{name: "gives up on a stuck server with ctx", body: "Buy milk", hang: true, timeout: 100 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeSMTP(t, tt.hang)
+			host, port, _ := net.SplitHostPort(addr)
+			notifier := newEmailNotifier(emailConfig{Host: host, Port: port, From: "todo@example.com", To: []string{"a@example.com", "b@example.com"}})
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := notifier.Notify(ctx, Notification{Action: "created", Todo: TodoIncoming{ID: 1, Body: tt.body}, Text: "Todo created:\nBuy milk"})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Notify() error = %v, want %v", err, tt.wantErr)
+				}
+				if elapsed := time.Since(start); elapsed > tt.timeout+time.Second {
+					t.Errorf("Notify() returned after %s, want about %s", elapsed, tt.timeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+
+			msg := <-received
+			for _, want := range []string{
+				// ReadDotBytes turns the CRLF line endings into LF.
+				"To: a@example.com, b@example.com\n",
+				tt.wantSubject,
+				"\n\nTodo created:\nBuy milk",
+			} {
+				if !strings.Contains(msg, want) {
+					t.Errorf("message %q does not contain %q", msg, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplatesFS embed.FS
+
+// templateCheckInterval limits how often the template directory is checked
+// for changes made through the mounted ConfigMap.
+const templateCheckInterval = 30 * time.Second
+
+// MessageData is what notification templates are rendered with.
+type MessageData struct {
+	Action   string
+	Todo     TodoIncoming
+	User     string
+	Hostname string
+	Time     time.Time
+}
+
+var markdownV2Replacer = func() *strings.Replacer {
+	var pairs []string
+	for _, c := range `\_*[]()~` + "`" + `>#+-=|{}.!` {
+		pairs = append(pairs, string(c), `\`+string(c))
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+var templateFuncs = template.FuncMap{
+	// markdownV2 escapes text for Telegram's MarkdownV2 parse mode.
+	"markdownV2": markdownV2Replacer.Replace,
+	// html escapes text for Telegram's HTML parse mode.
+	"html": html.EscapeString,
+	"json": func(v any) (string, error) {
+		b, err := json.MarshalIndent(v, "", "  ")
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// escaper returns the escape function of a Telegram parse mode: values
+// rendered through it show up literally instead of being read as markup.
+// Without a parse mode text is sent as is.
+func escaper(parseMode string) func(string) string {
+	switch parseMode {
+	case "MarkdownV2":
+		return markdownV2Replacer.Replace
+	case "HTML":
+		return html.EscapeString
+	}
+	return func(s string) string { return s }
+}
+
+// messageTemplates renders one template per action, e.g. created.tmpl.
+// Templates in dir override the embedded defaults and are reloaded when the
+// files change; default.tmpl is used for actions without their own file.
+type messageTemplates struct {
+	dir string
+	// funcs are templateFuncs plus escape for the parse mode.
+	funcs template.FuncMap
+
+	mu          sync.Mutex
+	tmpl        *template.Template
+	fingerprint string
+	checkedAt   time.Time
+}
+
+func newMessageTemplates(dir, parseMode string) (*messageTemplates, error) {
+	funcs := template.FuncMap{"escape": escaper(parseMode)}
+	maps.Copy(funcs, templateFuncs)
+	t := &messageTemplates{dir: dir, funcs: funcs}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dirFingerprint changes whenever a template file in dir is added, removed
+// or modified. Stat follows the ..data symlink of ConfigMap volumes.
+func dirFingerprint(dir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(matches)
+
+	var b strings.Builder
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+func (t *messageTemplates) reload() error {
+	tmpl, err := template.New("").Funcs(t.funcs).ParseFS(defaultTemplatesFS, "templates/*.tmpl")
+	if err != nil {
+		return fmt.Errorf("failed to parse embedded templates: %w", err)
+	}
+
+	fingerprint := ""
+	if t.dir != "" {
+		fingerprint, err = dirFingerprint(t.dir)
+		if err != nil {
+			return fmt.Errorf("failed to read templates from %s: %w", t.dir, err)
+		}
+		if fingerprint != "" {
+			tmpl, err = tmpl.ParseFS(os.DirFS(t.dir), "*.tmpl")
+			if err != nil {
+				return fmt.Errorf("failed to parse templates from %s: %w", t.dir, err)
+			}
+		}
+	}
+
+	t.tmpl = tmpl
+	t.fingerprint = fingerprint
+	t.checkedAt = time.Now()
+	return nil
+}
+
+func (t *messageTemplates) current() *template.Template {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.dir == "" || time.Since(t.checkedAt) < templateCheckInterval {
+		return t.tmpl
+	}
+	t.checkedAt = time.Now()
+
+	fingerprint, err := dirFingerprint(t.dir)
+	if err != nil || fingerprint == t.fingerprint {
+		return t.tmpl
+	}
+
+	// Keep serving the previous templates if the new ones are broken.
+	previous := t.tmpl
+	if err := t.reload(); err != nil {
+		slog.Error("Error reloading templates, keeping the previous ones", "dir", t.dir, "error", err)
+		t.tmpl, t.fingerprint = previous, fingerprint
+		return previous
+	}
+	slog.Info("Reloaded message templates", "dir", t.dir)
+	return t.tmpl
+}
+
+func (t *messageTemplates) render(data MessageData) (string, error) {
+	tmpl := t.current()
+
+	name := data.Action + ".tmpl"
+	if tmpl.Lookup(name) == nil {
+		name = "default.tmpl"
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", name, err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// validate renders every template with sample data so mistakes are
+// found at startup instead of on the first event.
+func (t *messageTemplates) validate() error {
+	sample := MessageData{
+		Todo:     TodoIncoming{ID: 1, Body: "Sample todo"},
+		User:     "broadcaster",
+		Hostname: "localhost",
+		Time:     time.Now(),
+	}
+
+	names, err := fs.Glob(defaultTemplatesFS, "templates/*.tmpl")
+	if err != nil {
+		return err
+	}
+	if t.dir != "" {
+		custom, _ := filepath.Glob(filepath.Join(t.dir, "*.tmpl"))
+		names = append(names, custom...)
+	}
+
+	for _, name := range names {
+		sample.Action = strings.TrimSuffix(filepath.Base(name), ".tmpl")
+		if _, err := t.render(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderDefaultTemplates(t *testing.T) {
+	data := func(action string, done bool) MessageData {
+		return MessageData{
+			Action:   action,
+			Todo:     TodoIncoming{ID: 7, Body: "Buy <milk> & *eggs* (2.5l)", Done: done},
+			User:     "broadcaster",
+			Hostname: "todo-broadcaster-5d8f.local",
+			Time:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+	}
+
+	tests := []struct {
+		name      string
+		parseMode string
+		data      MessageData
+		want      string
+	}{
+		{
+			name: "created without parse mode",
+			data: data("created", false),
+			want: "New todo 7:\nBuy <milk> & *eggs* (2.5l)\n\nbroadcasted by broadcaster @ todo-broadcaster-5d8f.local",
+		},
+		{
+			name:      "created as MarkdownV2",
+			parseMode: "MarkdownV2",
+			data:      data("created", false),
+			want:      "New todo 7:\nBuy <milk\\> & \\*eggs\\* \\(2\\.5l\\)\n\nbroadcasted by broadcaster @ todo\\-broadcaster\\-5d8f\\.local",
+		},
+		{
+			name:      "created as HTML",
+			parseMode: "HTML",
+			data:      data("created", false),
+			want:      "New todo 7:\nBuy &lt;milk&gt; &amp; *eggs* (2.5l)\n\nbroadcasted by broadcaster @ todo-broadcaster-5d8f.local",
+		},
+		{
+			name: "updated",
+			data: data("updated", false),
+			want: "Todo 7 was updated:\nBuy <milk> & *eggs* (2.5l)\n\nbroadcasted by broadcaster @ todo-broadcaster-5d8f.local",
+		},
+		{
+			name: "updated to done",
+			data: data("updated", true),
+			want: "Todo 7 is done:\nBuy <milk> & *eggs* (2.5l)\n\nbroadcasted by broadcaster @ todo-broadcaster-5d8f.local",
+		},
+		{
+			name:      "deleted as MarkdownV2",
+			parseMode: "MarkdownV2",
+			data:      data("deleted", false),
+			want:      "Todo 7 was deleted:\nBuy <milk\\> & \\*eggs\\* \\(2\\.5l\\)\n\nbroadcasted by broadcaster @ todo\\-broadcaster\\-5d8f\\.local",
+		},
+		{
+			name:      "unknown action falls back to default as MarkdownV2",
+			parseMode: "MarkdownV2",
+			data:      MessageData{Action: "archived", Todo: TodoIncoming{ID: 1, Body: "x"}, User: "u", Hostname: "h"},
+			want:      "A todo was archived:\n\\{\n  \"id\": 1,\n  \"body\": \"x\",\n  \"done\": false\n\\}\n\nbroadcasted by u @ h",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := newMessageTemplates("", tt.parseMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := templates.render(tt.data)
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("render() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderCustomTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		parseMode string
+		action    string
+		want      string
+		wantErr   string
+	}{
+		{
+			name:      "overrides a default",
+			files:     map[string]string{"created.tmpl": "*New todo* \\#{{ .Todo.ID }}\n{{ escape .Todo.Body }}"},
+			parseMode: "MarkdownV2",
+			action:    "created",
+			want:      "*New todo* \\#3\nwash\\-up\\!",
+		},
+		{
+			name:   "keeps the other defaults",
+			files:  map[string]string{"created.tmpl": "custom"},
+			action: "deleted",
+			want:   "Todo 3 was deleted:\nwash-up!\n\nbroadcasted by u @ h",
+		},
+		{
+			name:   "adds an action",
+			files:  map[string]string{"archived.tmpl": "{{ upper .Action }} {{ .Todo.ID }}"},
+			action: "archived",
+			want:   "ARCHIVED 3",
+		},
+		{
+			name:    "broken template",
+			files:   map[string]string{"created.tmpl": "{{ .Todo.ID "},
+			action:  "created",
+			wantErr: "failed to parse templates",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			templates, err := newMessageTemplates(dir, tt.parseMode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newMessageTemplates() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := templates.validate(); err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+
+			got, err := templates.render(MessageData{Action: tt.action, Todo: TodoIncoming{ID: 3, Body: "wash-up!"}, User: "u", Hostname: "h"})
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("render() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}